@@ -2,17 +2,47 @@ package main
 
 import (
 	"bufio"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"math/big"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
+// notes:
+// besides plain chat lines, two kinds of control lines are flooded through the network:
+// 		KEY [nonce] [public key]				announces a public key. the nonce makes every announcement unique
+// 		DM [fingerprint] [wrapped key] [ciphertext]	a direct message, only readable by the owner of the fingerprint
+// every peer forwards direct messages, but only the recipient holds the rsa key needed to unwrap the aes key.
+// inside the encryption, the sender signs the message, so nobody can send one in the name of another peer.
+
 var conns []net.Conn
 var msgSent map[string]bool
+var lock sync.Mutex // protects msgSent and keys
+
+var rsakey *rsa.PrivateKey         // our own key
+var keys map[string]*rsa.PublicKey // fingerprint to public key of every peer we have heard of
 
 func peer() {
 	msgSent = make(map[string]bool)
+	keys = make(map[string]*rsa.PublicKey)
+	rsakey, _ = rsa.GenerateKey(crand.Reader, 2048)
+	keys[fingerprint(&rsakey.PublicKey)] = &rsakey.PublicKey
 
 	fmt.Println("Please enter the address of a peer")
 	reader := bufio.NewReader(os.Stdin)
@@ -26,53 +56,303 @@ func peer() {
 
 	fmt.Println("I am trying to connect to " + addr)
 	// Try to connect
-	conn, err := net.Dial("tcp", addr)
+	conn, err := transport.Dial(addr)
 	if err == nil {
-		conns = append(conns, conn)
-		go msgReceiver(conn)
+		addConn(conn)
 		fmt.Println("Connected to address")
 	} else {
 		fmt.Println("No peer at address")
 	}
 
 	// Create server
-	ln, _ := net.Listen("tcp", ":0")
+	ln, _ := transport.Listen(":0")
 	fmt.Println("Server waiting for connection at " + ln.Addr().String())
 	go openConnection(ln)
 
 	fmt.Println("Ready for input. Send your message!")
+	fmt.Println("Your fingerprint is " + fingerprint(&rsakey.PublicKey) + ". Use /dm [fingerprint] [message] to send a direct message, and /keys to list known fingerprints.")
 	for {
-		msg, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-		broadcastMsg(msg)
+		msg, _ := reader.ReadString('\n')
+		switch {
+		case strings.HasPrefix(msg, "/dm "):
+			s := strings.SplitN(strings.TrimRight(msg, "\r\n"), " ", 3) // [/dm, fingerprint, message]
+			if len(s) < 3 {
+				fmt.Println("The format is /dm [fingerprint] [message]")
+				continue
+			}
+			sendDM(s[1], s[2])
+		case strings.HasPrefix(msg, "/keys"):
+			lock.Lock()
+			for k := range keys {
+				fmt.Println(k)
+			}
+			lock.Unlock()
+		default:
+			broadcastMsg(msg)
+		}
 	}
 }
 
+// register a new connection, and tell the network who we are
+func addConn(conn net.Conn) {
+	conns = append(conns, conn)
+	go msgReceiver(conn)
+	announceKey()
+}
+
 func msgReceiver(conn net.Conn) {
+	reader := bufio.NewReader(conn) // reuse the reader, otherwise buffered lines would be lost
 	for {
-		msg, _ := bufio.NewReader(conn).ReadString('\n')
+		msg, err := reader.ReadString('\n')
+		if err != nil {
+			return // the connection is closed
+		}
 		broadcastMsg(msg)
 	}
 }
 
 func broadcastMsg(msg string) {
-	if !msgSent[msg] { // Message has NOT been sent before
-		msgSent[msg] = true
+	lock.Lock()
+	if msgSent[msg] { // Message has been sent before
+		lock.Unlock()
+		return
+	}
+	msgSent[msg] = true
+	lock.Unlock()
+
+	switch {
+	case strings.HasPrefix(msg, "KEY "):
+		handleKey(msg)
+	case strings.HasPrefix(msg, "DM "):
+		handleDM(msg)
+	default:
 		fmt.Print(msg)
-		for _, conn := range conns {
-			conn.Write([]byte(msg))
-		}
+	}
+	for _, conn := range conns { // everything is forwarded, even direct messages meant for others
+		conn.Write([]byte(msg))
 	}
 }
 
+// flood our public key through the network
+func announceKey() {
+	der, _ := x509.MarshalPKIXPublicKey(&rsakey.PublicKey)
+	nonce := make([]byte, 8) // without the nonce, repeated announcements would be seen as duplicates
+	crand.Read(nonce)
+	broadcastMsg("KEY " + hex.EncodeToString(nonce) + " " + base64.StdEncoding.EncodeToString(der) + "\n")
+}
+
+// store an announced key. if it is new to us, the sender is probably new as well, so we announce ourselves
+func handleKey(msg string) {
+	s := strings.Fields(msg) // [KEY, nonce, key]
+	if len(s) != 3 {
+		return
+	}
+	der, err := base64.StdEncoding.DecodeString(s[2])
+	if err != nil {
+		return
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return
+	}
+	rsapub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return
+	}
+	fp := fingerprint(rsapub)
+	lock.Lock()
+	_, exists := keys[fp]
+	keys[fp] = rsapub
+	lock.Unlock()
+	if !exists {
+		fmt.Println(fp + " joined the chat")
+		go announceKey() // do not block the flood of the announcement we just received
+	}
+}
+
+// encrypt a message for the owner of the given fingerprint, and flood it
+func sendDM(to string, text string) {
+	lock.Lock()
+	pub, exists := keys[to]
+	lock.Unlock()
+	if !exists {
+		fmt.Println("Unknown fingerprint " + to)
+		return
+	}
+	signature, err := rsa.SignPSS(crand.Reader, rsakey, crypto.SHA256, dmHash(to, text), nil)
+	if err != nil {
+		fmt.Println("Could not sign the message")
+		return
+	}
+	// the sender and its signature, hidden from everyone but the recipient
+	plain := fingerprint(&rsakey.PublicKey) + " " + base64.StdEncoding.EncodeToString(signature) + " " + text
+
+	// hybrid encryption: a fresh aes key encrypts the message, and rsa encrypts the aes key
+	aeskey := make([]byte, 32)
+	crand.Read(aeskey)
+	block, _ := aes.NewCipher(aeskey)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	crand.Read(nonce)
+	c := gcm.Seal(nonce, nonce, []byte(plain), []byte(to)) // the nonce is stored in front of the ciphertext
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), crand.Reader, pub, aeskey, []byte("DM"))
+	if err != nil {
+		fmt.Println("Could not encrypt the message")
+		return
+	}
+	broadcastMsg("DM " + to + " " + base64.StdEncoding.EncodeToString(wrapped) + " " + base64.StdEncoding.EncodeToString(c) + "\n")
+}
+
+// print a direct message if it is addressed to us
+func handleDM(msg string) {
+	s := strings.Fields(msg) // [DM, fingerprint, wrapped key, ciphertext]
+	if len(s) != 4 || s[1] != fingerprint(&rsakey.PublicKey) {
+		return // malformed, or meant for someone else
+	}
+	wrapped, err1 := base64.StdEncoding.DecodeString(s[2])
+	c, err2 := base64.StdEncoding.DecodeString(s[3])
+	if err1 != nil || err2 != nil {
+		return
+	}
+	aeskey, err := rsa.DecryptOAEP(sha256.New(), crand.Reader, rsakey, wrapped, []byte("DM"))
+	if err != nil {
+		fmt.Println("Received a direct message that could not be decrypted")
+		return
+	}
+	block, _ := aes.NewCipher(aeskey)
+	gcm, _ := cipher.NewGCM(block)
+	if len(c) < gcm.NonceSize() {
+		return
+	}
+	plain, err := gcm.Open(nil, c[:gcm.NonceSize()], c[gcm.NonceSize():], []byte(s[1]))
+	if err != nil {
+		fmt.Println("Received a direct message that could not be decrypted")
+		return
+	}
+	m := strings.SplitN(string(plain), " ", 3) // [sender, signature, text]
+	if len(m) != 3 {
+		return
+	}
+	lock.Lock()
+	pub, exists := keys[m[0]]
+	lock.Unlock()
+	signature, err := base64.StdEncoding.DecodeString(m[1])
+	if !exists || err != nil || rsa.VerifyPSS(pub, crypto.SHA256, dmHash(s[1], m[2]), signature, nil) != nil {
+		fmt.Println("Received a direct message that was not signed by " + m[0])
+		return
+	}
+	fmt.Println("[DM from " + m[0] + "] " + m[2])
+}
+
+// the hash a direct message is signed on. the recipient is included, so the message cannot be passed on to another
+func dmHash(to string, text string) []byte {
+	h := sha256.Sum256([]byte(to + " " + text))
+	return h[:]
+}
+
+// short, printable identifier of a public key
+func fingerprint(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:8])
+}
+
+// a transport creates the connections between peers
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var transport Transport = tcpTransport{}
+
+// plain, unauthenticated tcp
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// mutually authenticated tls. every peer presents a self-signed certificate for its rsa key, with its
+// fingerprint as the common name. the key is new on every run and every address is only dialed once, so
+// there is nothing to pin. the handshake only proves that the other side holds the key it presents, and
+// the keys of both sides are learned just like announced keys
+type tlsTransport struct{}
+
+func (tlsTransport) Dial(addr string) (net.Conn, error) {
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{makeCertificate(rsakey)},
+		InsecureSkipVerify:    true, // there is no certificate authority, so we verify the certificate ourselves
+		VerifyPeerCertificate: verifyPeer,
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+func (tlsTransport) Listen(addr string) (net.Listener, error) {
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{makeCertificate(rsakey)},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifyPeer,
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// create a self-signed certificate for the given key
+func makeCertificate(key *rsa.PrivateKey) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: fingerprint(&key.PublicKey)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// verify the self-signed certificate of a peer, and learn its key
+func verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return err // not properly self-signed
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("peer did not present an rsa key")
+	}
+	fp := fingerprint(key)
+	if cert.Subject.CommonName != fp {
+		return errors.New("certificate was not issued to its own key")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	keys[fp] = key
+	return nil
+}
+
 func openConnection(ln net.Listener) {
 	fmt.Println("Waiting for connection...")
 	conn, _ := ln.Accept()
-	conns = append(conns, conn)
-	go msgReceiver(conn)
+	addConn(conn)
 	openConnection(ln)
 }
 
 func main() {
+	useTLS := flag.Bool("tls", false, "use mutually authenticated tls between peers")
+	flag.Parse()
+	if *useTLS {
+		transport = tlsTransport{}
+	}
 	msgSent = make(map[string]bool)
 	peer()
 }
@@ -2,9 +2,21 @@ package main
 
 import (
 	"bufio"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/rpc"
@@ -12,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // notes:
@@ -22,42 +35,53 @@ import (
 // 		really receive connections in large networks. by doing it randomly instead, everyone should be more
 // 		or less equally connected to the network.
 // everyone is initialized with 100$
+// with -raft, the peers instead form a raft group with a fixed set of members, and transactions are only
+// 		applied once a majority has stored them. see the raft section at the bottom
+// diagnostics go to stderr through a logger per subsystem, whose levels are set with -log
 
 var peers map[string]bool        // map of all known peers and if we are connected to them
 var conns map[string]*rpc.Client // map of all connected peers
 var ledger *Ledger
 var pastTransactions map[string]bool // transaction id to bools
+var rsakey *rsa.PrivateKey           // our own key, only used to authenticate tls connections
+var pins map[string]*rsa.PublicKey   // the key each address presented the first time we connected to it
+var pinsLock sync.Mutex              // pins are used during tls handshakes, which run concurrently
+var listenAddr string                // address our server listens on
 
-const debugCalls = false // debug rpc information
-const debug = true       // debug information
+// structured logging. every subsystem has its own logger with its own level, so the raft messages can be
+// followed without the rpc calls. logs go to stderr, so they do not mix with the output of commands
+var logRPC, logPeers, logLedger, logRaft *slog.Logger
+var logLevels = map[string]*slog.LevelVar{
+	"rpc":    new(slog.LevelVar), // inbound calls
+	"peers":  new(slog.LevelVar), // connections and membership
+	"ledger": new(slog.LevelVar), // transactions
+	"raft":   new(slog.LevelVar),
+}
+var logJSON bool // log json lines instead of text
 
 type Listener int
 
 func (l *Listener) MergePeers(request map[string]bool, reply *map[string]bool) error {
-	if debugCalls {
-		fmt.Println("MergePeers called!")
-	}
+	logRPC.Debug("called", "method", "MergePeers")
 	*reply = peers
 	merge(request)
 	return nil
 }
 
 func merge(cmap map[string]bool) {
+	added := 0
 	for k, _ := range cmap { // Iterating throgh clients map
 		_, exists := peers[k] // Check if the key exists in our map
 		if !exists {
 			peers[k] = false // If it does not, it is added
+			added++
 		}
 	}
-	if debug {
-		fmt.Println(peers)
-	}
+	logPeers.Debug("merged peers", "new", added, "known", len(peers))
 }
 
 func (l *Listener) MergeLedger(request Ledger, reply *Ledger) error {
-	if debugCalls {
-		fmt.Println("MergeLedger called!")
-	}
+	logRPC.Debug("called", "method", "MergeLedger")
 	request.lock.Lock()
 	ledger.lock.Lock()
 	for k, v := range request.Accounts {
@@ -70,26 +94,19 @@ func (l *Listener) MergeLedger(request Ledger, reply *Ledger) error {
 }
 
 func (l *Listener) MakeTransaction(request Transaction, reply *bool) error {
-	if debugCalls {
-		fmt.Println("MakeTransaction called!")
-	}
+	logRPC.Debug("called", "method", "MakeTransaction")
 	makeTransaction(request)
 	return nil
 }
 
 // make the target connect to the given address. used to ensure bidirectional connections
 func (l *Listener) BiConnect(request string, reply *bool) error {
-	if debugCalls {
-		fmt.Println("BiConnect called!")
-	}
-	conn, err := rpc.Dial("tcp", request)
+	logRPC.Debug("called", "method", "BiConnect")
+	conn, err := dial(request)
 	if err == nil {
-		fmt.Println("Bidirectional connection established with " + request)
+		logPeers.Info("bidirectional connection established", "peer", request)
 		peers[request] = true
 		conns[request] = conn
-		if debug {
-			fmt.Println(peers)
-		}
 	} else {
 		log.Fatal(err)
 	}
@@ -102,7 +119,7 @@ func makeTransaction(t Transaction) {
 		return // we have already seen this transaction
 	}
 	if ledger.Accounts[t.From]-t.Amount < 0 {
-		fmt.Println(t.From + " has insufficiant balance.")
+		logLedger.Info("rejected", "tx", t.ID, "from", t.From, "reason", "insufficient funds")
 		return // insufficient cash
 	}
 	ledger.lock.Lock()
@@ -111,10 +128,7 @@ func makeTransaction(t Transaction) {
 	ledger.lock.Unlock()
 	pastTransactions[t.ID] = true
 	broadcastTransaction(t)
-	if debug { // print the updated ledgers
-		fmt.Println("New ledger state: ")
-		fmt.Println(ledger.Accounts)
-	}
+	logLedger.Debug("applied", "tx", t.ID, "from", t.From, "to", t.To, "amount", t.Amount)
 }
 
 func broadcastTransaction(t Transaction) {
@@ -129,7 +143,15 @@ func peer() {
 	peers = make(map[string]bool)
 	conns = make(map[string]*rpc.Client)
 	pastTransactions = make(map[string]bool)
+	pins = make(map[string]*rsa.PublicKey)
 	ledger = MakeLedger()
+	if _, ok := transport.(*tlsTransport); ok {
+		rsakey = loadKey()
+	}
+	if raftMembers != nil {
+		raftPeer()
+		return
+	}
 
 	fmt.Println("Please enter the address of a peer")
 	addr, _ := bufio.NewReader(os.Stdin).ReadString('\n')
@@ -141,23 +163,32 @@ func peer() {
 	// handle input
 	fmt.Println("Ready to handle transactions. The format is [port] [port] [amount]. \nFor your convenience, a list of all known ports will be shown after each new transaction.")
 	for {
-		if debug {
-			fmt.Println(peers)
-		}
+		fmt.Println(peers) // the list of known ports promised above
 		msg, _ := bufio.NewReader(os.Stdin).ReadString('\n')
 		msg = strings.TrimRight(msg, "\n\r") // remove any trailing characters
-
-		b := make([]byte, 16) // used to generate uuid for the transaction
-		rand.Read(b)
-		s := strings.Split(msg, " ") // [from, to, amount]
-		v, _ := strconv.Atoi(s[2])   // convert amount to int
-		from := "[::]:" + s[0]       // since everything is local, it is enough to only input port numbers
-		to := "[::]:" + s[1]
-		t := Transaction{ID: fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), From: from, To: to, Amount: v}
+		t, err := parseTransaction(msg)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
 		makeTransaction(t)
 	}
 }
 
+// turn user input into a transaction
+func parseTransaction(msg string) (Transaction, error) {
+	b := make([]byte, 16) // used to generate uuid for the transaction
+	rand.Read(b)
+	s := strings.Split(msg, " ") // [from, to, amount]
+	if len(s) < 3 {
+		return Transaction{}, errors.New("the format is [port] [port] [amount]")
+	}
+	v, _ := strconv.Atoi(s[2]) // convert amount to int
+	from := "[::]:" + s[0]     // since everything is local, it is enough to only input port numbers
+	to := "[::]:" + s[1]
+	return Transaction{ID: fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), From: from, To: to, Amount: v}, nil
+}
+
 // we have to keep the same format of our addresses, since they are used to uniquely identify peers
 func formatAddr(addr string) string {
 	addr = strings.ReplaceAll(addr, "localhost", "[::]")
@@ -183,7 +214,7 @@ func connect(remote string, local string, recursive bool) {
 		}
 	}
 
-	conn, err := rpc.Dial("tcp", remote)
+	conn, err := dial(remote)
 	if err == nil { // if succesfull
 		peers[remote] = true
 		conns[remote] = conn
@@ -204,9 +235,13 @@ func connect(remote string, local string, recursive bool) {
 
 // start our own server on a random port, and return the address
 func startServer() string {
-	ln, _ := net.Listen("tcp", ":0")             // Listening on random port
+	ln, err := transport.Listen(listenAddr) // Listening on a random port, unless told otherwise
+	if err != nil {
+		log.Fatal(err)
+	}
 	peers[formatAddr(ln.Addr().String())] = true // by setting our own entry to true, we won't try to connect to it later
 	fmt.Println("Server waiting for connection at " + ln.Addr().String())
+	initLogging(formatAddr(ln.Addr().String()))
 	ledger.Accounts[formatAddr(ln.Addr().String())] = 100 // initialize our own account
 
 	// handle incoming method calls
@@ -218,11 +253,151 @@ func startServer() string {
 
 // listen for incoming rpc connections
 func openConnection(ln net.Listener) {
-	fmt.Println("Waiting for connection...")
 	rpc.Accept(ln)     // wait for connection
 	openConnection(ln) // go wait for further connections
 }
 
+// a transport creates the connections between peers
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var transport Transport = tcpTransport{}
+
+// connect to the rpc server at the given address, using the configured transport
+func dial(addr string) (*rpc.Client, error) {
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// plain, unauthenticated tcp
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// mutually authenticated tls. every peer presents a self-signed certificate with the fingerprint of its key as
+// the common name, so the name cannot be claimed by anyone else. the address a peer listens on is not in the
+// certificate, since anyone could claim any address. instead, the key presented by an address is pinned the
+// first time we connect to it, and every later connection to that address must present the same key
+type tlsTransport struct {
+	cert tls.Certificate
+}
+
+func (t *tlsTransport) Dial(addr string) (net.Conn, error) {
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{t.cert},
+		InsecureSkipVerify:    true, // there is no certificate authority, so we verify the certificate ourselves
+		VerifyPeerCertificate: verifyPeer(addr),
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.cert = makeCertificate(rsakey, fingerprint(&rsakey.PublicKey))
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{t.cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifyPeer(""),
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// create a self-signed certificate for the given key
+func makeCertificate(key *rsa.PrivateKey, name string) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// returns a function that verifies the certificate of a peer. the certificate must be issued to the
+// fingerprint of its own key. if addr is not empty, we connected to addr, and the key must be the one
+// pinned for it. a peer connecting to us is only known by its key, so nothing is pinned for it
+func verifyPeer(addr string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer did not present a certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+			return err // not properly self-signed
+		}
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("peer did not present an rsa key")
+		}
+		if cert.Subject.CommonName != fingerprint(key) {
+			return errors.New("certificate was not issued to its own key")
+		}
+		if addr == "" {
+			return nil
+		}
+		addr = formatAddr(addr)
+		pinsLock.Lock()
+		defer pinsLock.Unlock()
+		pinned, exists := pins[addr]
+		if !exists {
+			pins[addr] = key // trust on first use
+			return nil
+		}
+		if pinned.N.Cmp(key.N) != 0 || pinned.E != key.E {
+			return errors.New(addr + " presented " + fingerprint(key) + " instead of the pinned " + fingerprint(pinned))
+		}
+		return nil
+	}
+}
+
+// helper method, the key we authenticate with. with -raft-state it is kept next to the state, so a restarted
+// member presents the key the other members pinned for its address
+func loadKey() *rsa.PrivateKey {
+	if raftStateFile != "" {
+		if b, err := os.ReadFile(raftStateFile + ".key"); err == nil {
+			key, err := x509.ParsePKCS1PrivateKey(b)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return key
+		}
+	}
+	key, _ := rsa.GenerateKey(crand.Reader, 2048)
+	if raftStateFile != "" {
+		if err := os.WriteFile(raftStateFile+".key", x509.MarshalPKCS1PrivateKey(key), 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return key
+}
+
+// short, printable identifier of a public key
+func fingerprint(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:8])
+}
+
 func getipset(c map[string]bool) []string {
 	var ips []string
 	for k, _ := range c {
@@ -249,6 +424,512 @@ func MakeLedger() *Ledger {
 	return ledger
 }
 
+// raft mode. the members of the group are fixed and given on the command line. one of them is elected
+// leader, every transaction is appended to the log of the leader, and it is only applied to the ledger
+// once a majority of the group has stored it. every member applies the same log in the same order, so all
+// ledgers agree, and a transaction spending money twice is rejected by everyone instead of by no one
+
+var raftMembers []string // addresses of every member of the group, including ourselves
+var raftStateFile string // file the persistent state is stored in. if empty, nothing is persisted
+var raft *Raft
+
+const heartbeatInterval = 100 * time.Millisecond
+const electionTimeout = 500 * time.Millisecond // a random timeout between this and twice this is used
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+type LogEntry struct {
+	Term int
+	T    Transaction
+}
+
+type Raft struct {
+	lock    sync.Mutex
+	me      string
+	members []string
+	clients map[string]*rpc.Client // connections to the other members, made when first needed
+
+	// persistent state, saved before answering any rpc
+	CurrentTerm int
+	VotedFor    string
+	Log         []LogEntry // Log[0] is a placeholder, so the first real entry has index 1
+
+	state       int
+	leader      string // the member we believe is the leader of the current term
+	commitIndex int    // highest entry stored by a majority
+	lastApplied int    // highest entry applied to the ledger
+	nextIndex   map[string]int
+	matchIndex  map[string]int
+	deadline    time.Time // when we start an election, unless we hear from a leader first
+	applied     *sync.Cond
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	Candidate    string
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	Leader       string
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+}
+
+func MakeRaft(me string, members []string) *Raft {
+	r := new(Raft)
+	r.me = me
+	r.members = members
+	r.clients = make(map[string]*rpc.Client)
+	r.Log = []LogEntry{{}}
+	r.applied = sync.NewCond(&r.lock)
+	r.load()
+	r.resetDeadline()
+	return r
+}
+
+// run a peer as a member of a raft group
+func raftPeer() {
+	for _, member := range raftMembers {
+		ledger.Accounts[member] = 100 // everyone must start from the same ledger
+	}
+	myaddr := startServer()
+	isMember := false
+	for _, member := range raftMembers {
+		isMember = isMember || member == myaddr
+	}
+	if !isMember {
+		log.Fatal(myaddr + " is not a member of the raft group. use -listen to listen on the address given in -raft")
+	}
+	raft = MakeRaft(myaddr, raftMembers)
+	go raft.ticker()
+	go raft.applier()
+
+	fmt.Println("Ready to handle transactions. The format is [port] [port] [amount]. Transactions are sent to the leader, and applied once a majority has stored them.")
+	for {
+		msg, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		msg = strings.TrimRight(msg, "\n\r") // remove any trailing characters
+		t, err := parseTransaction(msg)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if err := raft.submit(t); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// ask for a vote in an election
+func (l *Listener) RequestVote(request RequestVoteArgs, reply *RequestVoteReply) error {
+	logRPC.Debug("called", "method", "RequestVote")
+	r := raft
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if request.Term > r.CurrentTerm {
+		r.becomeFollower(request.Term)
+	}
+	reply.Term = r.CurrentTerm
+	if request.Term < r.CurrentTerm || (r.VotedFor != "" && r.VotedFor != request.Candidate) {
+		return nil
+	}
+	// only vote for candidates whose log is at least as up to date as ours, so a leader always has every committed entry
+	last := len(r.Log) - 1
+	if request.LastLogTerm < r.Log[last].Term || (request.LastLogTerm == r.Log[last].Term && request.LastLogIndex < last) {
+		return nil
+	}
+	r.VotedFor = request.Candidate
+	r.save()
+	r.resetDeadline()
+	reply.VoteGranted = true
+	return nil
+}
+
+// replicate entries of the log of the leader. with no entries, this is a heartbeat
+func (l *Listener) AppendEntries(request AppendEntriesArgs, reply *AppendEntriesReply) error {
+	logRPC.Debug("called", "method", "AppendEntries")
+	r := raft
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if request.Term > r.CurrentTerm || (request.Term == r.CurrentTerm && r.state == candidate) {
+		r.becomeFollower(request.Term)
+	}
+	reply.Term = r.CurrentTerm
+	if request.Term < r.CurrentTerm {
+		return nil // an old leader
+	}
+	r.leader = request.Leader
+	r.resetDeadline()
+	if request.PrevLogIndex >= len(r.Log) || r.Log[request.PrevLogIndex].Term != request.PrevLogTerm {
+		return nil // we are missing entries, the leader will retry from an earlier entry
+	}
+	for i, entry := range request.Entries {
+		index := request.PrevLogIndex + 1 + i
+		if index < len(r.Log) && r.Log[index].Term == entry.Term {
+			continue // already stored
+		}
+		r.Log = append(r.Log[:index], request.Entries[i:]...) // drop everything that conflicts with the leader
+		break
+	}
+	if len(request.Entries) > 0 {
+		r.save()
+	}
+	if request.LeaderCommit > r.commitIndex {
+		r.commitIndex = min(request.LeaderCommit, request.PrevLogIndex+len(request.Entries))
+		r.applied.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+// forward a transaction to the leader
+func (l *Listener) Submit(request Transaction, reply *bool) error {
+	logRPC.Debug("called", "method", "Submit")
+	return raft.submit(request)
+}
+
+// append a transaction to the log if we are the leader, otherwise send it to the leader
+func (r *Raft) submit(t Transaction) error {
+	r.lock.Lock()
+	if r.state == leader {
+		r.Log = append(r.Log, LogEntry{Term: r.CurrentTerm, T: t})
+		r.save()
+		r.broadcastAppendEntries()
+		r.lock.Unlock()
+		return nil
+	}
+	leaderAddr := r.leader
+	r.lock.Unlock()
+	if leaderAddr == "" {
+		return errors.New("there is no leader right now, try again")
+	}
+	var reply bool
+	return r.call(leaderAddr, "Listener.Submit", t, &reply)
+}
+
+// start elections when we have not heard from a leader for too long, and send heartbeats when we are the leader
+func (r *Raft) ticker() {
+	for {
+		time.Sleep(heartbeatInterval)
+		r.lock.Lock()
+		if r.state == leader {
+			r.broadcastAppendEntries()
+		} else if time.Now().After(r.deadline) {
+			r.startElection()
+		}
+		r.lock.Unlock()
+	}
+}
+
+// helper method, become a candidate and ask everyone for their vote. the lock must be held
+func (r *Raft) startElection() {
+	r.state = candidate
+	r.CurrentTerm++
+	r.VotedFor = r.me
+	r.save()
+	r.resetDeadline()
+	term := r.CurrentTerm
+	logRaft.Info("starting an election", "term", term)
+	args := RequestVoteArgs{Term: term, Candidate: r.me, LastLogIndex: len(r.Log) - 1, LastLogTerm: r.Log[len(r.Log)-1].Term}
+	votes := 1
+	for _, member := range r.members {
+		if member == r.me {
+			continue
+		}
+		go func(member string) {
+			var reply RequestVoteReply
+			if r.call(member, "Listener.RequestVote", args, &reply) != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if reply.Term > r.CurrentTerm {
+				r.becomeFollower(reply.Term)
+				return
+			}
+			if r.state != candidate || r.CurrentTerm != term || !reply.VoteGranted {
+				return // the election is over
+			}
+			votes++
+			if votes > len(r.members)/2 {
+				r.becomeLeader()
+			}
+		}(member)
+	}
+	if len(r.members) == 1 {
+		r.becomeLeader()
+	}
+}
+
+// helper method. the lock must be held
+func (r *Raft) becomeLeader() {
+	logRaft.Info("elected leader", "term", r.CurrentTerm)
+	r.state = leader
+	r.leader = r.me
+	r.nextIndex = make(map[string]int)
+	r.matchIndex = make(map[string]int)
+	for _, member := range r.members {
+		r.nextIndex[member] = len(r.Log)
+	}
+	r.broadcastAppendEntries()
+}
+
+// helper method, step down when we see a newer term. the lock must be held
+func (r *Raft) becomeFollower(term int) {
+	if term > r.CurrentTerm {
+		r.CurrentTerm = term
+		r.VotedFor = ""
+		r.leader = ""
+		r.save()
+	}
+	r.state = follower
+	r.resetDeadline()
+}
+
+// helper method, send the entries every member is missing. the lock must be held
+func (r *Raft) broadcastAppendEntries() {
+	if len(r.members) == 1 {
+		r.advanceCommitIndex()
+	}
+	for _, member := range r.members {
+		if member == r.me {
+			continue
+		}
+		prev := r.nextIndex[member] - 1
+		args := AppendEntriesArgs{
+			Term:         r.CurrentTerm,
+			Leader:       r.me,
+			PrevLogIndex: prev,
+			PrevLogTerm:  r.Log[prev].Term,
+			Entries:      append([]LogEntry{}, r.Log[prev+1:]...),
+			LeaderCommit: r.commitIndex,
+		}
+		go func(member string) {
+			var reply AppendEntriesReply
+			if r.call(member, "Listener.AppendEntries", args, &reply) != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if reply.Term > r.CurrentTerm {
+				r.becomeFollower(reply.Term)
+				return
+			}
+			if r.state != leader || r.CurrentTerm != args.Term {
+				return
+			}
+			if reply.Success {
+				match := args.PrevLogIndex + len(args.Entries)
+				if match > r.matchIndex[member] {
+					r.matchIndex[member] = match
+					r.nextIndex[member] = match + 1
+				}
+				r.advanceCommitIndex()
+			} else if r.nextIndex[member] > 1 {
+				r.nextIndex[member]-- // the member is missing entries, try one further back next time
+			}
+		}(member)
+	}
+}
+
+// helper method, commit the entries stored by a majority. only entries of the current term are counted,
+// older ones are committed along with them. the lock must be held
+func (r *Raft) advanceCommitIndex() {
+	for n := len(r.Log) - 1; n > r.commitIndex && r.Log[n].Term == r.CurrentTerm; n-- {
+		count := 1 // ourselves
+		for member, match := range r.matchIndex {
+			if member != r.me && match >= n {
+				count++
+			}
+		}
+		if count > len(r.members)/2 {
+			r.commitIndex = n
+			r.applied.Broadcast()
+			return
+		}
+	}
+}
+
+// apply committed entries to the ledger, in the order of the log
+func (r *Raft) applier() {
+	r.lock.Lock()
+	for {
+		for r.lastApplied >= r.commitIndex {
+			r.applied.Wait()
+		}
+		r.lastApplied++
+		t := r.Log[r.lastApplied].T
+		r.lock.Unlock()
+		applyCommitted(t)
+		r.lock.Lock()
+	}
+}
+
+// helper method, applies a committed transaction. since every member applies the same transactions in the same
+// order, they all accept and reject the same transactions
+func applyCommitted(t Transaction) {
+	if pastTransactions[t.ID] {
+		return
+	}
+	pastTransactions[t.ID] = true
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	if t.Amount < 0 || ledger.Accounts[t.From]-t.Amount < 0 {
+		logLedger.Info("rejected", "tx", t.ID, "from", t.From, "reason", "insufficient funds")
+		return
+	}
+	ledger.Accounts[t.From] -= t.Amount
+	ledger.Accounts[t.To] += t.Amount
+	logLedger.Debug("applied", "tx", t.ID, "from", t.From, "to", t.To, "amount", t.Amount)
+}
+
+// helper method, call a method on another member. the connection is made again if it was lost
+func (r *Raft) call(member string, method string, args interface{}, reply interface{}) error {
+	r.lock.Lock()
+	client := r.clients[member]
+	r.lock.Unlock()
+	if client == nil {
+		c, err := dial(member)
+		if err != nil {
+			return err
+		}
+		client = c
+		r.lock.Lock()
+		r.clients[member] = client
+		r.lock.Unlock()
+	}
+	err := client.Call(method, args, reply)
+	if err == rpc.ErrShutdown || errors.Is(err, net.ErrClosed) {
+		r.lock.Lock()
+		if r.clients[member] == client {
+			delete(r.clients, member)
+		}
+		r.lock.Unlock()
+	}
+	return err
+}
+
+// helper method. the lock must be held
+func (r *Raft) resetDeadline() {
+	r.deadline = time.Now().Add(electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout))))
+}
+
+// helper method, write the persistent state to disk. the lock must be held
+func (r *Raft) save() {
+	if raftStateFile == "" {
+		return
+	}
+	b, _ := json.Marshal(r)
+	if err := os.WriteFile(raftStateFile+".tmp", b, 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(raftStateFile+".tmp", raftStateFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// helper method, read the persistent state from disk, if there is any
+func (r *Raft) load() {
+	if raftStateFile == "" {
+		return
+	}
+	b, err := os.ReadFile(raftStateFile)
+	if err != nil {
+		return // a new member
+	}
+	if err := json.Unmarshal(b, r); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// create the loggers. called again once we listen, so every line carries the address identifying us
+func initLogging(node string) {
+	newLogger := func(subsystem string) *slog.Logger {
+		options := &slog.HandlerOptions{Level: logLevels[subsystem]}
+		var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+		if logJSON {
+			handler = slog.NewJSONHandler(os.Stderr, options)
+		}
+		logger := slog.New(handler).With("subsystem", subsystem)
+		if node != "" {
+			logger = logger.With("node", node)
+		}
+		return logger
+	}
+	logRPC = newLogger("rpc")
+	logPeers = newLogger("peers")
+	logLedger = newLogger("ledger")
+	logRaft = newLogger("raft")
+}
+
+// set the levels of the subsystems from a list such as "rpc=debug,ledger=warn". a level without a
+// subsystem sets the level of all of them
+func setLogLevels(list string) error {
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, found := strings.Cut(part, "=")
+		if !found {
+			subsystem, name = "", part
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return err
+		}
+		if subsystem == "" {
+			for _, v := range logLevels {
+				v.Set(level)
+			}
+			continue
+		}
+		v, exists := logLevels[subsystem]
+		if !exists {
+			return errors.New("unknown subsystem " + subsystem + ", the subsystems are rpc, peers, ledger and raft")
+		}
+		v.Set(level)
+	}
+	return nil
+}
+
 func main() {
+	useTLS := flag.Bool("tls", false, "use mutually authenticated tls between peers")
+	group := flag.String("raft", "", "comma separated addresses of all members of a raft group, including ourselves. if set, transactions are replicated with raft instead of flooded")
+	flag.StringVar(&raftStateFile, "raft-state", "", "file the raft state is persisted in, so the peer can be restarted. with -tls, the key is kept in the same file with .key appended")
+	flag.StringVar(&listenAddr, "listen", ":0", "address to listen on")
+	logList := flag.String("log", "info", "log levels, such as debug, or rpc=debug,ledger=warn for single subsystems. the subsystems are rpc, peers, ledger and raft")
+	flag.BoolVar(&logJSON, "log-json", false, "log json lines instead of text")
+	flag.Parse()
+	if err := setLogLevels(*logList); err != nil {
+		log.Fatal(err)
+	}
+	initLogging("")
+	if *useTLS {
+		transport = &tlsTransport{}
+	}
+	if *group != "" {
+		for _, member := range strings.Split(*group, ",") {
+			raftMembers = append(raftMembers, formatAddr(strings.TrimSpace(member)))
+		}
+	}
 	peer()
 }
@@ -4,167 +4,765 @@ import (
 	"bufio"
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"math"
+	"math/big"
 	rand "math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/exec"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // notes:
-// no mutex is acquired before writing to the maps. this should be implemented in transaction-heavy networks
+// every shared map is guarded by a mutex, named next to it below. transactions are verified concurrently, but
+// 		applied one at a time by a single goroutine, so the ledger always sees them in one order
 // bidirectional connections are *required* for the network to work properly
 // instead of sorting the peers and connecting to the 10 upper entries, we decided to just connect to 10
 // 		random peers instead. otherwise only the lucky few with low port numbers (high on the list) would
 // 		really receive connections in large networks. by doing it randomly instead, everyone should be more
 // 		or less equally connected to the network.
-// everyone is initialized with 100$
+// peers are identified by a node id, the scheme and hash of their public key, and not by their address. a
+// 		peer can be reachable at several addresses, which are gossiped along with its id. the id is also its account
+// all money comes from the genesis file, which lists the accounts and their initial balances. learning a
+// 		key never credits anything, since anyone can make up as many keys as they like. without a genesis,
+// 		no account has any money
+// 		when joining, peers exchange their transaction histories and replay them, instead of copying balances
 
-var rsakey *rsa.PrivateKey         // our own key
-var keys map[string]*rsa.PublicKey // map of all known peers and their public keys
-var peers map[string]bool          // map of all known peers and if we are connected to them
-var conns map[string]*rpc.Client   // map of all connected peers
+var signer crypto.Signer         // our own key
+var myid string                  // our own node id, which is also our account
+var myaddrs []string             // the addresses we tell other peers to reach us at
+var myself Node                  // our signed address record, made once our addresses are known
+var keys map[string]string       // map of all known peers and their public keys, encoded with encodeKey
+var keysLock sync.Mutex          // keys are also read during tls handshakes, which run concurrently
+var peers map[string]bool        // map of all known peers, by node id, and if we are connected to them
+var addrs map[string][]string    // the addresses of every known peer
+var nodes map[string]Node        // the latest signed address record of every known peer
+var peersLock sync.Mutex         // protects peers, addrs and nodes, which are read by background goroutines while rpc handlers change them
+var conns map[string]*rpc.Client // map of all connected peers, by node id
+var outboxes map[string]*Outbox  // queue of outbound calls to every connected peer
+var connsLock sync.Mutex         // protects conns and outboxes
 var ledger *Ledger
-var pastTransactions map[string]bool // transaction id to bools
+var pastTransactions map[string]bool       // transaction id to bools. guarded by ledger.lock
+var proposals map[string]SignedTransaction // transactions from shared accounts that are still collecting signatures, by their hash
+var proposalsLock sync.Mutex
+var mempool *Mempool   // valid transactions the sender cannot afford yet
+var genesis *Genesis   // the initial state of the network. nil when running without a genesis file
+var genesisHash string // peers only talk to peers with the same genesis hash
+var rules Rules        // the rules every transaction must follow, taken from the genesis
 
-const debugCalls = true // debug rpc information
-const debug = true      // debug information
+var keyFile string    // file our key is stored in. if empty, a fresh key is generated on every run
+var keyScheme Scheme  // signature scheme used when generating our key
+var listenAddr string // address our server listens on
+var advertise string  // comma separated addresses other peers reach us at. if empty, the address we listen on
+var mempoolTimeout time.Duration
+var verifiers int // number of goroutines verifying signatures
+var antiEntropyInterval time.Duration
+
+var seed int64          // seed of all randomness that does not have to be secure, so a run can be repeated
+var rng *rand.Rand      // seeded with seed
+var rngLock sync.Mutex  // rand.Rand is not safe for concurrent use
+var trace *json.Encoder // where inbound calls are recorded. nil when not recording
+var traceLock sync.Mutex
+
+// structured logging. every subsystem has its own logger with its own level, so one subsystem can be debugged
+// in a large network without drowning in the output of the others. the levels are set with -log, and can be
+// changed while running with the log command. logs go to stderr, so they do not mix with the output of commands
+var logRPC, logPeers, logLedger, logPbft, logNet *slog.Logger
+var logLevels = map[string]*slog.LevelVar{
+	"rpc":    new(slog.LevelVar), // inbound calls
+	"peers":  new(slog.LevelVar), // connections, membership and discovery
+	"ledger": new(slog.LevelVar), // transactions and the mempool
+	"pbft":   new(slog.LevelVar),
+	"net":    new(slog.LevelVar), // outbound queues
+}
+var logJSON bool // log json lines instead of text
 
 type Listener int
 
-// merge the peer maps of the caller and the callee
-func (l *Listener) MergePeers(request map[string]bool, reply *map[string]bool) error {
-	if debugCalls {
-		fmt.Println("MergePeers called!")
-	}
-	*reply = peers
+// merge the peer directories of the caller and the callee
+func (l *Listener) MergePeers(request map[string]Node, reply *map[string]Node) error {
+	defer rpcCall("MergePeers")()
+	record("MergePeers", request)
+	*reply = signedDirectory()
 	mergePeers(request)
 	return nil
 }
 
-// helper method, merges two peer maps
-func mergePeers(rpeers map[string]bool) {
-	for k, _ := range rpeers {
-		_, exists := peers[k]
-		if !exists {
-			peers[k] = false
+// helper method, merges a peer directory into ours
+func mergePeers(rpeers map[string]Node) {
+	for _, n := range rpeers {
+		learnNode(n)
+	}
+	peersLock.Lock()
+	known := len(peers)
+	peersLock.Unlock()
+	logPeers.Debug("merged peers", "known", known)
+}
+
+// a peer, and the addresses it can be reached at. the record is signed by the peer itself, so nobody else
+// can make up addresses for it, and a newer record replaces the addresses of an older one
+type Node struct {
+	ID        string
+	Addrs     []string
+	Key       string // encoded with encodeKey. its node id must be ID
+	Time      int64  // unix time in nanoseconds when the record was made
+	Signature []byte
+	Trace     *SpanContext `json:"-"` // the span of the peer that told us about the node, if it is being announced
+}
+
+const maxNodeAddrs = 8 // a record with more addresses than this is ignored
+
+func (n Node) hash() []byte {
+	n.Signature = nil
+	return hashJSON(n)
+}
+
+// ourselves, as we tell other peers
+func me() Node {
+	return myself
+}
+
+// create the signed record of our addresses
+func makeNode() Node {
+	n := Node{ID: myid, Addrs: myaddrs, Key: encodeKey(signer.Public()), Time: time.Now().UnixNano()}
+	n.Signature, _ = signWith(signer, n.hash())
+	return n
+}
+
+// helper method, whether a record was signed by the node it describes. records from the future are
+// rejected, so a peer cannot make a record that is never replaced
+func validNode(n Node) bool {
+	if len(n.Addrs) > maxNodeAddrs || time.Until(time.Unix(0, n.Time)) > beaconMaxAge {
+		return false
+	}
+	key, scheme, err := decodeKey(n.Key)
+	return err == nil && nodeID(key) == n.ID && scheme.Verify(key, n.hash(), n.Signature)
+}
+
+// helper method, remembers a peer and its addresses. returns whether the peer was new to us. only the
+// latest record of every peer is kept, so its addresses do not pile up
+func learnNode(n Node) bool {
+	if n.ID == "" || n.ID == myid || departed(n.ID) {
+		return false
+	}
+	peersLock.Lock()
+	latest := nodes[n.ID].Time >= n.Time
+	peersLock.Unlock()
+	if latest {
+		return false // nothing new, and no signature to check
+	}
+	if !validNode(n) {
+		logPeers.Debug("ignored address record", "peer", n.ID)
+		return false
+	}
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	_, exists := peers[n.ID]
+	if !exists {
+		peers[n.ID] = false
+	}
+	if nodes[n.ID].Time < n.Time {
+		n.Trace = nil
+		nodes[n.ID] = n
+		addrs[n.ID] = n.Addrs
+	}
+	return !exists
+}
+
+// helper method, adds the addresses that are not in the list yet
+func appendNew(list []string, more []string) []string {
+	for _, a := range more {
+		known := false
+		for _, b := range list {
+			known = known || a == b
 		}
+		if !known {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// the addresses of every peer we know, including ourselves
+func directory() map[string][]string {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	dir := make(map[string][]string)
+	for id := range peers {
+		dir[id] = append([]string{}, addrs[id]...)
 	}
-	if debug {
-		fmt.Println(peers)
+	if myid != "" {
+		dir[myid] = myaddrs
 	}
+	return dir
+}
+
+// the signed records of every peer we know, including ourselves, as they are sent to other peers
+func signedDirectory() map[string]Node {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	dir := make(map[string]Node)
+	for id, n := range nodes {
+		dir[id] = n
+	}
+	if myid != "" {
+		dir[myid] = me()
+	}
+	return dir
 }
 
 // merge the key maps of the caller and the callee
-func (l *Listener) MergeKeys(request map[string]*rsa.PublicKey, reply *map[string]*rsa.PublicKey) error {
-	if debugCalls {
-		fmt.Println("MergePeers called!")
+func (l *Listener) MergeKeys(request map[string]string, reply *map[string]string) error {
+	defer rpcCall("MergeKeys")()
+	record("MergeKeys", request)
+	keysLock.Lock()
+	current := make(map[string]string)
+	for k, v := range keys {
+		current[k] = v
 	}
-	*reply = keys
+	keysLock.Unlock()
+	*reply = current
 	mergeKeys(request)
 	return nil
 }
 
-// helper method, merges two key maps
-func mergeKeys(rkeys map[string]*rsa.PublicKey) {
+// helper method, merges two key maps. keys we already know are pinned, and never replaced
+func mergeKeys(rkeys map[string]string) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
 	for k, v := range rkeys {
-		keys[k] = v
-	}
-	if debug {
-		fmt.Println("I now know " + fmt.Sprint(len(keys)) + " unique keys")
+		key, _, err := decodeKey(v)
+		if err != nil {
+			continue // not a key of any scheme we support
+		}
+		if nodeID(key) != k {
+			continue // the key does not own this id, so it may not sign for it
+		}
+		old, exists := keys[k]
+		if !exists {
+			keys[k] = v
+		} else if old != v {
+			logPeers.Warn("ignoring a conflicting key", "peer", k)
+		}
 	}
+	logPeers.Debug("merged keys", "known", len(keys))
 }
 
 // make the callee broadcast the presence of a new node
-func (l *Listener) BroadcastNewNode(request string, reply *bool) error {
-	if debugCalls {
-		fmt.Println("BroadcastNewNode called!")
-	}
-	_, exists := peers[request] // do we already know this guy (or gal)
-	if !exists {
-		peers[request] = false
+func (l *Listener) BroadcastNewNode(request Node, reply *bool) error {
+	defer rpcCall("BroadcastNewNode")()
+	record("BroadcastNewNode", request)
+	span := startSpan("BroadcastNewNode", request.Trace, "peer.id", request.ID)
+	if learnNode(request) { // do we already know this guy (or gal)
+		logPeers.Info("learned of a new peer", "peer", request.ID, "addrs", request.Addrs)
+		request.Trace = span.context()
 		broadcastNewNode(request) // if this is a new guy (or gal), tell our friends about him (or her)
-	}
-	if debug {
-		fmt.Println(peers)
+		span.end("new")
+	} else {
+		span.end("known")
 	}
 	return nil
 }
 
-// helper method, broadcasts an ip to all known connections
-func broadcastNewNode(ip string) {
-	for _, v := range conns {
-		var reply bool
-		v.Call("Listener.BroadcastNewNode", ip, &reply)
-	}
+// helper method, broadcasts a node to all known connections
+func broadcastNewNode(n Node) {
+	broadcast("Listener.BroadcastNewNode", n)
 }
 
-// merge the ledger of the caller and the callee
-func (l *Listener) MergeLedger(request Ledger, reply *Ledger) error {
-	if debugCalls {
-		fmt.Println("MergeLedger called!")
-	}
-	request.lock.Lock()
-	ledger.lock.Lock()
-	for k, v := range request.Accounts {
-		ledger.Accounts[k] = v // assume everything is already synchronized
-	}
-	request.lock.Unlock()
-	ledger.lock.Unlock()
-	*reply = *ledger // replace their ledger with ours
+// exchange transaction histories. the callee replays the history of the caller, and replies with its own
+func (l *Listener) SyncHistory(request []SignedTransaction, reply *[]SignedTransaction) error {
+	defer rpcCall("SyncHistory")()
+	record("SyncHistory", request)
+	*reply = ledger.getHistory()
+	replayHistory(request)
 	return nil
 }
 
+// helper method, validates and applies every transaction of a remote history we have not seen yet.
+// balances are never copied from other peers, they only change through transactions we have validated ourselves
+func replayHistory(h []SignedTransaction) {
+	for _, st := range h {
+		makeSignedTransaction(st)
+	}
+}
+
 // make the callee perform a transaction
 func (l *Listener) MakeSignedTransaction(request SignedTransaction, reply *bool) error {
-	if debugCalls {
-		fmt.Println("MakeSignedTransaction called!")
-	}
-	makeSignedTransaction(request)
+	defer rpcCall("MakeSignedTransaction", "tx", request.T.ID)()
+	record("MakeSignedTransaction", request)
+	makeSignedTransaction(traceTransaction(request, "MakeSignedTransaction"))
 	return nil
 }
 
-// helper method, performs the actual transaction
+// helper method, hands a transaction to the validation pipeline. when the queue is full, this blocks
+// until there is room, slowing down whoever is sending us transactions
 func makeSignedTransaction(st SignedTransaction) {
+	if pbft != nil {
+		st.span.end("ordering")
+		pbft.request(st) // the order is agreed on first
+		return
+	}
+	inPipeline.Add(1)
+	verifyQueue <- st
+}
+
+// the validation pipeline. a pool of verifiers checks the rules and the signatures in parallel, since
+// that is the expensive part, and a single applier applies the valid transactions one at a time. the
+// applier is the only goroutine changing balances
+var verifyQueue chan SignedTransaction
+var applyQueue chan SignedTransaction
+
+// signatures we have already verified, so transactions we receive from several peers are only verified once
+var verified map[[32]byte]bool
+var verifiedLock sync.Mutex
+
+// transactions that are still in the pipeline. used to wait for the pipeline when replaying
+var inPipeline sync.WaitGroup
+
+const queueSize = 1024        // transactions waiting in each stage of the pipeline
+const verifiedCacheSize = 1e5 // signatures to remember before the cache is cleared
+
+func startPipeline(workers int) {
+	verifyQueue = make(chan SignedTransaction, queueSize)
+	applyQueue = make(chan SignedTransaction, queueSize)
+	verified = make(map[[32]byte]bool)
+	for i := 0; i < workers; i++ {
+		go verifier()
+	}
+	go applier()
+}
+
+func verifier() {
+	for st := range verifyQueue {
+		if checkTransaction(st) {
+			applyQueue <- st
+		} else {
+			inPipeline.Done()
+		}
+	}
+}
+
+func applier() {
+	for st := range applyQueue {
+		applyTransaction(st)
+		inPipeline.Done()
+	}
+}
+
+// helper method, checks everything about a transaction that does not depend on balances
+func checkTransaction(st SignedTransaction) bool {
 	t := st.T
+	ledger.lock.Lock()
 	_, exists := pastTransactions[t.ID]
+	ledger.lock.Unlock()
 	if exists {
-		return // we have already seen this transaction
+		reject(st, "duplicate")
+		return false // we have already seen this transaction
+	}
+	if err := validateRules(t); err != nil {
+		logLedger.Info("rejected", "tx", t.ID, "reason", err.Error())
+		reject(st, "rules")
+		return false // breaks the rules of the network
+	}
+	if t.Policy != nil {
+		if pinned(t.To) { // peers learn other keys at different times, so only the genesis decides
+			logLedger.Info("rejected", "tx", t.ID, "reason", "the shared account is already owned by a key", "account", t.To)
+			reject(st, "shared_account")
+			return false
+		}
+	}
+	h := signatureHash(st)
+	verifiedLock.Lock()
+	cached := verified[h]
+	verifiedLock.Unlock()
+	if cached {
+		return true
 	}
 	if !validateSignature(st) {
-		fmt.Println("Signature was invalid!")
-		return // invalid signature
+		logLedger.Info("rejected", "tx", t.ID, "reason", "invalid signature")
+		reject(st, "bad_signature")
+		return false // invalid signature
 	}
-	fmt.Println("Signature was valid!")
-	if ledger.Accounts[t.From]-t.Amount < 0 {
-		return // insufficient cash
+	logLedger.Debug("valid signature", "tx", t.ID)
+	verifiedLock.Lock()
+	if len(verified) >= verifiedCacheSize {
+		verified = make(map[[32]byte]bool)
 	}
+	verified[h] = true
+	verifiedLock.Unlock()
+	return true
+}
+
+// hash a transaction together with its signatures. keys and policies never change once they are
+// known, so a signature that was valid once stays valid
+func signatureHash(st SignedTransaction) [32]byte {
+	h := crypto.SHA256.New()
+	h.Write(hashMessage(st.T))
+	h.Write(st.Signature)
+	owners := make([]string, 0, len(st.Signatures))
+	for owner := range st.Signatures {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		h.Write([]byte(owner))
+		h.Write(st.Signatures[owner])
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// helper method, applies a transaction that has passed the checks. only called by the applier
+func applyTransaction(st SignedTransaction) {
+	if settleTransaction(st) {
+		mempool.retry(credited(st.T)...) // some pending transactions of these accounts might be fundable now
+	}
+}
+
+// helper method, the accounts whose balance grows when a transaction is applied
+func credited(t Transaction) []string {
+	if rules.FeeAccount != "" {
+		return []string{t.To, rules.FeeAccount}
+	}
+	return []string{t.To}
+}
+
+// helper method, applies a transaction, or adds it to the mempool if it cannot be funded yet. returns
+// whether it was applied
+func settleTransaction(st SignedTransaction) bool {
+	status := applySignedTransaction(st)
+	if status == unfunded {
+		mempool.add(st) // it might become fundable once we see the transactions it depends on
+		return false
+	}
+	mempool.remove(st.T.ID)
+	switch status {
+	case duplicate:
+		reject(st, "duplicate")
+		return false
+	case rejected:
+		reject(st, "shared_account")
+		return false
+	}
+	st.span.end("applied")
+	metrics.appliedTotal.Add(1)
+	broadcastTransaction(st)
+	logLedger.Debug("applied", "tx", st.T.ID, "from", st.T.From, "to", st.T.To, "amount", st.T.Amount, "fee", st.T.Fee)
+	return true
+}
+
+// the possible outcomes of applying a transaction
+const (
+	applied   = iota // the transaction was applied to the ledger
+	duplicate        // the transaction has already been applied
+	rejected         // the transaction is invalid, and never will be valid
+	unfunded         // the transaction is valid, but the sender cannot afford it (yet)
+)
+
+// helper method, applies a checked transaction to the ledger
+func applySignedTransaction(st SignedTransaction) int {
+	t := st.T
 	ledger.lock.Lock()
-	ledger.Accounts[t.From] -= t.Amount
+	defer ledger.lock.Unlock()
+	if pastTransactions[t.ID] {
+		return duplicate // applied in the meantime
+	}
+	if t.Policy != nil {
+		if _, exists := ledger.Accounts[t.To]; exists {
+			logLedger.Info("rejected", "tx", t.ID, "reason", "the shared account already exists", "account", t.To)
+			return rejected
+		}
+	}
+	if ledger.Accounts[t.From]-t.Amount-t.Fee < 0 {
+		return unfunded // insufficient cash
+	}
+	ledger.Accounts[t.From] -= t.Amount + t.Fee
 	ledger.Accounts[t.To] += t.Amount
-	ledger.lock.Unlock()
+	if rules.FeeAccount != "" {
+		ledger.Accounts[rules.FeeAccount] += t.Fee
+	} else {
+		ledger.burned += t.Fee
+	}
+	if t.Policy != nil {
+		ledger.Policies[t.To] = *t.Policy // the new account is now controlled by its owners
+	}
+	st.Trace, st.span = nil, nil // the history is sent to other peers, long after this hop
+	ledger.history = append(ledger.history, st)
 	pastTransactions[t.ID] = true
-	broadcastTransaction(st)
-	if debug { // print the updated ledgers
-		fmt.Println("New ledger state: ")
-		fmt.Println(ledger.Accounts)
+	ledger.updateRoot(t.From, t.To)
+	if rules.FeeAccount != "" {
+		ledger.updateRoot(rules.FeeAccount)
+	}
+	return applied
+}
+
+// return the transactions waiting in our mempool
+func (l *Listener) GetMempool(request bool, reply *[]SignedTransaction) error {
+	defer rpcCall("GetMempool")()
+	*reply = mempool.contents()
+	return nil
+}
+
+// a summary of our ledger, used to compare it with the ledgers of other peers
+type StateHash struct {
+	ID     string          // node id of the peer
+	Root   string          // merkle root of the accounts, hex encoded
+	Height int             // number of transactions applied
+	Supply int             // all money ever created
+	Burned int             // fees that were burned
+	Total  int             // the sum of all balances. should be Supply - Burned
+	Peers  map[string]Node // every peer we know of, and its signed addresses
+}
+
+// reply, for each of the given transaction ids, whether we have applied the transaction. used by the benchmark
+func (l *Listener) HasTransactions(request []string, reply *[]bool) error {
+	defer rpcCall("HasTransactions")()
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	*reply = make([]bool, len(request))
+	for i, id := range request {
+		(*reply)[i] = pastTransactions[id]
+	}
+	return nil
+}
+
+// return the state hash of our ledger
+func (l *Listener) GetStateHash(request bool, reply *StateHash) error {
+	defer rpcCall("GetStateHash")()
+	reply.ID = myid
+	ledger.lock.Lock()
+	reply.Root = hex.EncodeToString(ledger.root)
+	reply.Height = len(ledger.history)
+	reply.Supply = ledger.supply
+	reply.Burned = ledger.burned
+	for _, balance := range ledger.Accounts {
+		reply.Total += balance
+	}
+	ledger.lock.Unlock()
+	reply.Peers = signedDirectory()
+	return nil
+}
+
+// return the balance of an account, with a proof against our signed root
+func (l *Listener) GetBalanceWithProof(request string, reply *BalanceProof) error {
+	defer rpcCall("GetBalanceWithProof")()
+	ledger.lock.Lock()
+	*reply = ledger.prove(request)
+	reply.Root = SignedRoot{Root: ledger.root, Height: len(ledger.history)}
+	ledger.lock.Unlock()
+	signRoot(&reply.Root)
+	return nil
+}
+
+// return our current root, signed with our key
+func (l *Listener) GetSignedRoot(request bool, reply *SignedRoot) error {
+	defer rpcCall("GetSignedRoot")()
+	ledger.lock.Lock()
+	*reply = SignedRoot{Root: ledger.root, Height: len(ledger.history)}
+	ledger.lock.Unlock()
+	signRoot(reply)
+	return nil
+}
+
+// helper method, signs a root with our own key
+func signRoot(r *SignedRoot) {
+	r.Signer = myid
+	r.Signature, _ = signWith(signer, rootMessage(*r))
+}
+
+// the hashed message that is signed for a root
+func rootMessage(r SignedRoot) []byte {
+	b, _ := json.Marshal(SignedRoot{Root: r.Root, Height: r.Height, Signer: r.Signer})
+	h := crypto.SHA256.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// the validation pipeline. every transaction we receive must pass all of these before it is applied
+var pipeline = []func(t Transaction) error{
+	positiveAmount,
+	minimumFee,
+	maximumAmount,
+	noSelfTransfer,
+	validPolicy,
+}
+
+// run a transaction through the validation pipeline, and return the first rule it breaks
+func validateRules(t Transaction) error {
+	for _, rule := range pipeline {
+		if err := rule(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func positiveAmount(t Transaction) error {
+	if t.Amount <= 0 {
+		return errors.New("the amount must be positive")
+	}
+	return nil
+}
+
+func minimumFee(t Transaction) error {
+	if t.Fee < rules.MinFee {
+		return errors.New("the fee must be at least " + fmt.Sprint(rules.MinFee))
+	}
+	return nil
+}
+
+func maximumAmount(t Transaction) error {
+	if rules.MaxAmount > 0 && t.Amount > rules.MaxAmount {
+		return errors.New("the amount must be at most " + fmt.Sprint(rules.MaxAmount))
+	}
+	return nil
+}
+
+func noSelfTransfer(t Transaction) error {
+	if !rules.AllowSelfTransfer && t.From == t.To {
+		return errors.New("an account cannot send to itself")
+	}
+	return nil
+}
+
+func validPolicy(t Transaction) error {
+	if t.Policy == nil {
+		return nil
+	}
+	owners := make(map[string]bool)
+	for _, owner := range t.Policy.Owners {
+		if owners[owner] {
+			return errors.New("the owners of a shared account must be distinct")
+		}
+		owners[owner] = true
+	}
+	if t.Policy.Threshold < 1 || t.Policy.Threshold > len(owners) {
+		return errors.New("the threshold must be between 1 and the number of owners")
 	}
+	if strings.Contains(t.To, ":") { // the account of a key could otherwise be taken before its owner shows up
+		return errors.New("a shared account cannot be named like a node id or an address")
+	}
+	return nil
 }
 
-// validate a given signed transaction
+// validate a given signed transaction. transactions from shared accounts need enough signatures of the owners
 func validateSignature(t SignedTransaction) bool {
-	if rsa.VerifyPSS(keys[t.T.From], crypto.SHA256, hashMessage(t.T), t.Signature, nil) == nil {
-		return true
+	ledger.lock.Lock()
+	policy, shared := ledger.Policies[t.T.From]
+	ledger.lock.Unlock()
+	if shared {
+		return validateThreshold(t, policy)
+	}
+	return verify(t.T.From, hashMessage(t.T), t.Signature)
+}
+
+// count the valid signatures of the owners, and check that there are enough of them
+func validateThreshold(t SignedTransaction, policy Policy) bool {
+	hm := hashMessage(t.T)
+	n := 0
+	for _, owner := range policy.Owners {
+		signature, exists := t.Signatures[owner]
+		if exists && verify(owner, hm, signature) {
+			n++
+		}
+	}
+	return n >= policy.Threshold
+}
+
+// verify a signature of the given account on a hashed message, using the scheme of its key
+func verify(account string, hm []byte, signature []byte) bool {
+	keysLock.Lock()
+	encoded, exists := keys[account]
+	keysLock.Unlock()
+	if !exists {
+		return false
+	}
+	key, scheme, err := decodeKey(encoded)
+	if err != nil {
+		return false
+	}
+	return scheme.Verify(key, hm, signature)
+}
+
+// collect signatures for a transaction from a shared account
+func (l *Listener) ProposeTransaction(request SignedTransaction, reply *bool) error {
+	defer rpcCall("ProposeTransaction", "tx", request.T.ID)()
+	record("ProposeTransaction", request)
+	proposeTransaction(request)
+	return nil
+}
+
+// helper method, merges the signatures of a proposal into the ones we know. if we learn new signatures,
+// the proposal is passed on, and once there are enough signatures the transaction is performed
+func proposeTransaction(st SignedTransaction) {
+	ledger.lock.Lock()
+	done := pastTransactions[st.T.ID]
+	ledger.lock.Unlock()
+	if done {
+		return
+	}
+	hm := hashMessage(st.T)
+	key := string(hm) // not the id, so another transaction with the same id is a separate proposal
+	proposalsLock.Lock()
+	p, exists := proposals[key]
+	if !exists {
+		p = SignedTransaction{T: st.T, Signatures: make(map[string][]byte)}
+	}
+	changed := false
+	for owner, signature := range st.Signatures {
+		if _, known := p.Signatures[owner]; !known && verify(owner, hm, signature) {
+			p.Signatures[owner] = signature
+			changed = true
+		}
+	}
+	proposals[key] = p
+	merged := SignedTransaction{T: p.T, Signatures: make(map[string][]byte)}
+	for owner, signature := range p.Signatures {
+		merged.Signatures[owner] = signature
+	}
+	proposalsLock.Unlock()
+	if !changed {
+		return
+	}
+	if !exists {
+		t := st.T
+		fmt.Println("Proposal " + t.ID + ": " + t.From + " sends " + fmt.Sprint(t.Amount) + " to " + t.To + ". Type 'approve " + t.ID + "' to sign it.")
+	}
+	broadcast("Listener.ProposeTransaction", merged)
+	if validateSignature(merged) {
+		makeSignedTransaction(merged)
+		proposalsLock.Lock()
+		delete(proposals, key)
+		proposalsLock.Unlock()
 	}
-	return false
 }
 
 // serialize a transaction structure, and hash it
@@ -182,176 +780,4224 @@ func hashMessage(t Transaction) []byte {
 
 // helper method, broadcast a transaction to all our connections
 func broadcastTransaction(t SignedTransaction) {
-	for _, v := range conns {
-		var reply bool
-		v.Call("Listener.MakeSignedTransaction", t, &reply)
-	}
+	broadcast("Listener.MakeSignedTransaction", t)
 }
 
-// make the target connect to the given address. used to ensure bidirectional connections
-func (l *Listener) BiConnect(request string, reply *bool) error {
-	if debugCalls {
-		fmt.Println("BiConnect called!")
-	}
-	conn, err := rpc.Dial("tcp", request)
-	if err == nil {
-		fmt.Println("Bidirectional connection established with " + request)
-		peers[request] = true
-		conns[request] = conn
-		if debug {
-			fmt.Println(peers)
+// reply with the transactions we have applied that are not in the summary of the caller
+func (l *Listener) Reconcile(request Summary, reply *[]SignedTransaction) error {
+	defer rpcCall("Reconcile")()
+	record("Reconcile", request)
+	for _, st := range ledger.getHistory() {
+		if !request.contains(st.T.ID) {
+			*reply = append(*reply, st)
+			if len(*reply) == maxReconcile {
+				break
+			}
 		}
-	} else {
-		log.Fatal(err)
 	}
 	return nil
 }
 
-func peer() {
-	// initialize all variables
-	keys = make(map[string]*rsa.PublicKey)
-	peers = make(map[string]bool)
-	conns = make(map[string]*rpc.Client)
-	pastTransactions = make(map[string]bool)
-	ledger = MakeLedger()
-	rsakey, _ = rsa.GenerateKey(crand.Reader, 2048)
-
-	// wait for input, and prepare for operation when received
-	fmt.Println("Please enter the address of a peer")
-	addr, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-	addr = strings.TrimRight(addr, "\r\n") // os-independent way of removing newline characters
-	myaddr := startServer()
-	keys[myaddr] = &rsakey.PublicKey // add our own key to the keyset
-	connect(formatAddr(addr), myaddr, true)
-
-	// handle transaction input
-	fmt.Println("Ready to handle transactions. The format is [port] [amount]. For your convenience, a list of all known ports will be shown after each new transaction.")
+// anti-entropy. broadcasts are never repeated, so a peer that was disconnected while a transaction flooded
+// the network would never learn of it. instead, every round we send a summary of the transactions we have
+// applied to a random known peer, which replies with the ones we are missing. if our connection to it was
+// lost, a new one is made for the round
+func antiEntropy(interval time.Duration) {
 	for {
-		if debug {
-			fmt.Println(peers)
+		time.Sleep(interval)
+		var others []string
+		peersLock.Lock()
+		for _, p := range getipset(peers) {
+			if p != myid {
+				others = append(others, p)
+			}
 		}
-		msg, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-		msg = strings.TrimRight(msg, "\n\r") // remove any trailing characters
-
-		b := make([]byte, 16) // used to generate uuid for the transaction
-		rand.Read(b)
-		s := strings.Split(msg, " ") // [to, amount]
-		v, _ := strconv.Atoi(s[1])   // convert amount to int
-		if v < 0 {
-			fmt.Println("You cannot send a negative amount!")
+		peersLock.Unlock()
+		if len(others) == 0 {
 			continue
 		}
-		to := "[::]:" + s[0]
-		from := myaddr // we can only send from ourselves (we do not know any other secret keys)
-		t := Transaction{ID: fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), From: from, To: to, Amount: v}
+		rngLock.Lock()
+		other := others[rng.Intn(len(others))]
+		salt := rng.Uint64()
+		rngLock.Unlock()
+		connsLock.Lock()
+		conn, connected := conns[other]
+		connsLock.Unlock()
 
-		// broadcast the transaction
-		signature, _ := rsa.SignPSS(crand.Reader, rsakey, crypto.SHA256, hashMessage(t), nil)
-		st := SignedTransaction{T: t, Signature: signature}
-		makeSignedTransaction(st)
+		summary := makeSummary(salt)
+		var missing []SignedTransaction
+		err := errors.New("not connected")
+		if connected {
+			err = conn.Call("Listener.Reconcile", summary, &missing)
+			if connectionFailed(err) {
+				dropConnection(other, conn, err)
+			}
+		}
+		if err != nil {
+			missing = nil
+			peersLock.Lock()
+			as := append([]string{}, addrs[other]...)
+			peersLock.Unlock()
+			c, err := dialNode(Node{ID: other, Addrs: as})
+			if err != nil {
+				continue
+			}
+			err = c.Call("Listener.Reconcile", summary, &missing)
+			c.Close()
+			if err != nil {
+				continue
+			}
+		}
+		if len(missing) > 0 {
+			logLedger.Info("learned of missed transactions", "peer", other, "count", len(missing))
+			record("ReconcileReply", missing)
+			replayHistory(missing)
+		}
 	}
 }
 
-// we have to keep the same format of our addresses, since they are used to uniquely identify peers
-func formatAddr(addr string) string {
-	addr = strings.ReplaceAll(addr, "localhost", "[::]")
-	addr = strings.ReplaceAll(addr, "127.0.0.1", "[::]")
-	return addr
+// a bloom filter of the ids of the transactions a peer has applied. the salt changes every round, so a
+// transaction hidden by a false positive in one round is found in a later one
+type Summary struct {
+	Bits []uint64
+	Salt uint64
 }
 
-// connect to a server that may not be active
-func connect(remote string, local string, recursive bool) {
-	// recursively connect to the targets set of connections
-	recConnect := func(connections map[string]bool) {
-		ips := getipset(connections) // get the keyset of peers
-		n := 0                       // successes
-		m := 0                       // attempts
-		for float64(n) < math.Min(2.0, float64(len(peers))) && m < 99 {
-			r := rand.Intn(len(peers)) // roll a dice
-			if !peers[ips[r]] {        // if we are not connected to this guy
-				connect(ips[r], local, false) // connect to him non-recursively
-				n += 1
-			} else {
-				m += 1
-			}
+const bloomBitsPerID = 10 // with 7 hashes, about 1% false positives
+const bloomHashes = 7
+const maxReconcile = 1000 // transactions sent in reply to a single summary
+
+// summarize the transactions we have applied
+func makeSummary(salt uint64) Summary {
+	history := ledger.getHistory()
+	s := Summary{Bits: make([]uint64, (len(history)*bloomBitsPerID)/64+1), Salt: salt}
+	for _, st := range history {
+		for _, i := range s.positions(st.T.ID) {
+			s.Bits[i/64] |= 1 << (i % 64)
 		}
 	}
+	return s
+}
 
-	conn, err := rpc.Dial("tcp", remote)
-	if err == nil {
-		peers[remote] = true
-		conns[remote] = conn
-		remotePeers := make(map[string]bool)          // remote peer set
-		remoteKeys := make(map[string]*rsa.PublicKey) // remote key set
-		var reply bool
-		conn.Call("Listener.BroadcastNewNode", local, &reply)
-		conn.Call("Listener.MergePeers", peers, &remotePeers)
-		conn.Call("Listener.MergeKeys", keys, &remoteKeys)
-		conn.Call("Listener.MergeLedger", ledger, &ledger)
-		conn.Call("Listener.BiConnect", local, &reply)
-		if recursive {
-			recConnect(remotePeers)
+// whether an id might be in the summary. false positives are possible, false negatives are not
+func (s Summary) contains(id string) bool {
+	if len(s.Bits) == 0 {
+		return false
+	}
+	for _, i := range s.positions(id) {
+		if s.Bits[i/64]&(1<<(i%64)) == 0 {
+			return false
 		}
-		mergePeers(remotePeers)
-		mergeKeys(remoteKeys)
-		fmt.Println("Connected to " + remote)
-	} else {
-		fmt.Println("No peer at address")
 	}
+	return true
 }
 
-// start our own server on a random port, and return the address
-func startServer() string {
-	ln, _ := net.Listen("tcp", ":0")
-	peers[ln.Addr().String()] = true // by setting our own entry to true, we won't try to connect to it later
-	fmt.Println("Server waiting for connection at " + ln.Addr().String())
-	ledger.Accounts[formatAddr(ln.Addr().String())] = 100 // initialize our own account
-
-	// handle incoming method calls
-	listener := new(Listener)
-	rpc.Register(listener)
-	go openConnection(ln)
-	return formatAddr(ln.Addr().String())
+// helper method, the bits an id is stored in
+func (s Summary) positions(id string) []uint64 {
+	h := crypto.SHA256.New()
+	h.Write([]byte(fmt.Sprint(s.Salt) + ":" + id))
+	sum := h.Sum(nil)
+	n := uint64(len(s.Bits)) * 64
+	positions := make([]uint64, bloomHashes)
+	for k := range positions {
+		positions[k] = uint64(sum[4*k])<<24 | uint64(sum[4*k+1])<<16 | uint64(sum[4*k+2])<<8 | uint64(sum[4*k+3])
+		positions[k] %= n
+	}
+	return positions
+}
+
+// queue a call to every connection. this never waits for the peers, so a slow peer cannot hold up the
+// rest of the network, and the handler that received the message returns right away
+func broadcast(method string, args interface{}) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	for _, o := range outboxes {
+		o.enqueue(method, args)
+	}
+}
+
+// a peer announces that it leaves the network. it is removed from our peer map, and a tombstone keeps it
+// from being added again by peers that have not heard of the leave yet
+func (l *Listener) Leave(request Membership, reply *bool) error {
+	defer rpcCall("Leave")()
+	record("Leave", request)
+	if !newMembership(request) {
+		return nil
+	}
+	membershipLock.Lock()
+	tombstones[request.ID] = time.Now().Add(tombstoneTTL)
+	membershipLock.Unlock()
+	peersLock.Lock()
+	delete(peers, request.ID)
+	delete(addrs, request.ID)
+	delete(nodes, request.ID)
+	peersLock.Unlock()
+	connsLock.Lock()
+	if o, exists := outboxes[request.ID]; exists {
+		o.close()
+		conns[request.ID].Close()
+		delete(outboxes, request.ID)
+		delete(conns, request.ID)
+	}
+	connsLock.Unlock()
+	logPeers.Info("peer left the network", "peer", request.ID)
+	broadcast("Listener.Leave", request)
+	return nil
+}
+
+// a peer that has left comes back with the same key. this removes its tombstone, so it can be added again
+func (l *Listener) Rejoin(request Membership, reply *bool) error {
+	defer rpcCall("Rejoin")()
+	record("Rejoin", request)
+	membershipLock.Lock()
+	_, dead := tombstones[request.ID]
+	membershipLock.Unlock()
+	if !dead || !newMembership(request) {
+		return nil // we have nothing to forget
+	}
+	membershipLock.Lock()
+	delete(tombstones, request.ID)
+	membershipLock.Unlock()
+	logPeers.Info("peer rejoined the network", "peer", request.ID)
+	broadcast("Listener.Rejoin", request)
+	return nil
+}
+
+// a signed announcement that a peer leaves or rejoins the network. the time orders the announcements of
+// a peer, so an old announcement cannot be replayed to undo a newer one
+type Membership struct {
+	ID        string // node id of the peer
+	Leave     bool
+	Time      int64 // unix time in nanoseconds
+	Signature []byte
+}
+
+var tombstones map[string]time.Time // peers that have left, until their tombstone expires
+var announced map[string]int64      // time of the latest announcement of every peer
+var membershipLock sync.Mutex
+
+const tombstoneTTL = 10 * time.Minute
+
+// create a signed announcement for ourselves
+func announce(leave bool) Membership {
+	m := Membership{ID: myid, Leave: leave, Time: time.Now().UnixNano()}
+	m.Signature, _ = signWith(signer, m.hash())
+	return m
+}
+
+func (m Membership) hash() []byte {
+	m.Signature = nil
+	return hashJSON(m)
+}
+
+// helper method, whether an announcement is validly signed and newer than any we have seen from the peer
+func newMembership(m Membership) bool {
+	if m.ID == myid || !verify(m.ID, m.hash(), m.Signature) {
+		return false
+	}
+	membershipLock.Lock()
+	defer membershipLock.Unlock()
+	if m.Time <= announced[m.ID] {
+		return false
+	}
+	announced[m.ID] = m.Time
+	return true
+}
+
+// whether a peer has left the network. expired tombstones are removed
+func departed(id string) bool {
+	membershipLock.Lock()
+	defer membershipLock.Unlock()
+	expires, exists := tombstones[id]
+	if exists && time.Now().After(expires) {
+		delete(tombstones, id)
+		return false
+	}
+	return exists
+}
+
+// tell everyone we leave, and exit. the announcement is sent directly instead of through the outboxes,
+// so we know it has arrived before we exit
+func leave() {
+	m := announce(true)
+	connsLock.Lock()
+	clients := make([]*rpc.Client, 0, len(conns))
+	for _, conn := range conns {
+		clients = append(clients, conn)
+	}
+	connsLock.Unlock()
+	for _, conn := range clients {
+		var reply bool
+		conn.Call("Listener.Leave", m, &reply)
+	}
+	fmt.Println("Left the network")
+	os.Exit(0)
+}
+
+// lan discovery. every peer multicasts a signed beacon with its node id, key and addresses, so peers on the
+// same lan find each other without typing in an address. a peer that is not connected to anyone connects to
+// the first peer it hears of, so two peers started at the same time still end up in the same network.
+// discovery is only on with -discover, since it joins whoever is on the lan
+type Beacon struct {
+	Node      Node
+	Key       string // encoded with encodeKey. its node id must be Node.ID
+	Genesis   string // peers with another genesis are of no use to us
+	Time      int64  // unix time in nanoseconds. old beacons are ignored, so they cannot be repeated forever
+	Signature []byte
+}
+
+var discoveryGroup string // multicast address the beacons are sent to. empty when discovery is off
+var beaconInterval time.Duration
+var discovered map[string]Node // nodes we have heard beacons from, by node id
+var discoveredLock sync.Mutex
+var bootstrapped atomic.Bool // whether we are done with our first connection
+
+const beaconMaxAge = time.Minute
+const maxBeaconSize = 8192
+
+func (b Beacon) hash() []byte {
+	b.Signature = nil
+	return hashJSON(b)
+}
+
+// create a signed beacon for ourselves
+func makeBeacon() Beacon {
+	b := Beacon{Node: me(), Key: encodeKey(signer.Public()), Genesis: genesisHash, Time: time.Now().UnixNano()}
+	b.Signature, _ = signWith(signer, b.hash())
+	return b
+}
+
+// multicast a beacon every interval
+func sendBeacons() {
+	group, err := net.ResolveUDPAddr("udp", discoveryGroup)
+	if err != nil {
+		logPeers.Warn("not sending beacons", "err", err)
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, group)
+	if err != nil {
+		logPeers.Warn("not sending beacons", "err", err)
+		return
+	}
+	defer conn.Close()
+	for {
+		msg, _ := json.Marshal(makeBeacon())
+		conn.Write(msg)
+		time.Sleep(beaconInterval)
+	}
+}
+
+// listen for the beacons of other peers
+func listenBeacons() {
+	group, err := net.ResolveUDPAddr("udp", discoveryGroup)
+	if err != nil {
+		logPeers.Warn("not listening for beacons", "err", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp", nil, group)
+	if err != nil {
+		logPeers.Warn("not listening for beacons", "err", err)
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, maxBeaconSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logPeers.Warn("reading a beacon failed", "err", err)
+			continue
+		}
+		var b Beacon
+		if json.Unmarshal(buf[:n], &b) != nil || !validBeacon(b) {
+			continue
+		}
+		node := Node{ID: b.Node.ID}
+		for _, a := range b.Node.Addrs {
+			node.Addrs = append(node.Addrs, reachableAt(a, from.IP))
+		}
+		heard(node)
+	}
+}
+
+// helper method, whether a beacon is recent, from another peer with our genesis, and signed by the key of its node id
+func validBeacon(b Beacon) bool {
+	if b.Node.ID == myid || b.Genesis != genesisHash {
+		return false
+	}
+	age := time.Since(time.Unix(0, b.Time))
+	if age > beaconMaxAge || age < -beaconMaxAge {
+		return false
+	}
+	key, scheme, err := decodeKey(b.Key)
+	return err == nil && nodeID(key) == b.Node.ID && scheme.Verify(key, b.hash(), b.Signature)
+}
+
+// helper method, an address without a host, such as ":7000" or "[::]:7000", is reached at the host the beacon came from
+func reachableAt(addr string, ip net.IP) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if parsed := net.ParseIP(host); host == "" || (parsed != nil && parsed.IsUnspecified()) {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return addr
+}
+
+// helper method, remembers a node we heard a beacon from, and connects to it if we are alone
+func heard(n Node) {
+	discoveredLock.Lock()
+	_, exists := discovered[n.ID]
+	discovered[n.ID] = n
+	discoveredLock.Unlock()
+	if !exists {
+		logPeers.Info("discovered a peer", "peer", n.ID, "addrs", n.Addrs)
+	}
+	if !bootstrapped.Load() || departed(n.ID) {
+		return // the first connection is made by peer()
+	}
+	connsLock.Lock()
+	alone := len(conns) == 0
+	connsLock.Unlock()
+	if alone {
+		connectNode(n, true)
+	}
+}
+
+// wait until we have heard of other peers, and return them in a random order. returns nothing if no
+// beacon arrived in time
+func discover(wait time.Duration) []Node {
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		discoveredLock.Lock()
+		var nodes []Node
+		for _, n := range discovered {
+			nodes = append(nodes, n)
+		}
+		discoveredLock.Unlock()
+		if len(nodes) > 0 {
+			sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID }) // so the seed decides the order
+			rngLock.Lock()
+			rng.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+			rngLock.Unlock()
+			return nodes
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logPeers.Info("no peers found on the lan")
+	return nil
+}
+
+// connect recursively to the first of the given nodes that answers
+func bootstrapFrom(nodes []Node) bool {
+	for _, n := range nodes {
+		if connectNode(n, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// seed nodes. a seed node is not a peer, it only keeps track of the peers that are alive, so new peers have
+// somewhere to start that does not depend on any single peer staying up. peers register with a signed beacon,
+// and have to register again before the ttl runs out, otherwise they are forgotten. any number of seed nodes
+// can run side by side, they exchange their registrations so each of them knows every live peer. the seed
+// nodes hand out the addresses the peers advertise, so peers outside a single machine should use -advertise
+type SeedNode struct {
+	lock    sync.Mutex
+	beacons map[string]Beacon // the latest beacon of every live peer, by node id
+	ttl     time.Duration
+	others  []string // addresses of the other seed nodes
+}
+
+var seeds []string // addresses of the seed nodes
+var seedTTL time.Duration
+
+const seedPeers = 8 // peers handed out by a seed node at a time
+
+// register a peer, or renew its registration
+func (s *SeedNode) Register(request Beacon, reply *bool) error {
+	defer rpcCall("Register")()
+	if !validBeacon(request) {
+		return errors.New("invalid beacon")
+	}
+	*reply = s.add(request)
+	return nil
+}
+
+// reply with a random subset of the live peers
+func (s *SeedNode) GetPeers(request int, reply *[]Node) error {
+	defer rpcCall("GetPeers")()
+	if request <= 0 || request > seedPeers {
+		request = seedPeers
+	}
+	live := s.live()
+	rngLock.Lock()
+	rng.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	rngLock.Unlock()
+	for i := 0; i < len(live) && i < request; i++ {
+		*reply = append(*reply, live[i].Node)
+	}
+	return nil
+}
+
+// exchange registrations with another seed node. the beacons are signed, so a seed node cannot register
+// peers that do not exist, and they expire at the same time everywhere
+func (s *SeedNode) Exchange(request []Beacon, reply *[]Beacon) error {
+	defer rpcCall("Exchange")()
+	*reply = s.live()
+	for _, b := range request {
+		if validBeacon(b) {
+			s.add(b)
+		}
+	}
+	return nil
+}
+
+// helper method, stores a beacon if it is newer than the one we have. returns whether it was
+func (s *SeedNode) add(b Beacon) bool {
+	if time.Since(time.Unix(0, b.Time)) > s.ttl {
+		return false // expired, another seed node just has not noticed yet
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, exists := s.beacons[b.Node.ID]
+	if exists && old.Time >= b.Time {
+		return false
+	}
+	if !exists {
+		logPeers.Info("registered", "peer", b.Node.ID, "addrs", b.Node.Addrs)
+	}
+	s.beacons[b.Node.ID] = b
+	return true
+}
+
+// helper method, the beacons of the peers whose ttl has not run out, sorted by node id. expired ones are removed
+func (s *SeedNode) live() []Beacon {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var live []Beacon
+	for id, b := range s.beacons {
+		if time.Since(time.Unix(0, b.Time)) > s.ttl {
+			logPeers.Info("registration expired", "peer", id)
+			delete(s.beacons, id)
+			continue
+		}
+		live = append(live, b)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Node.ID < live[j].Node.ID })
+	return live
+}
+
+// exchange registrations with the other seed nodes a few times per ttl
+func (s *SeedNode) exchange() {
+	for {
+		time.Sleep(s.ttl / 3)
+		for _, other := range s.others {
+			var reply []Beacon
+			if err := callAny([]string{other}, "Seed.Exchange", s.live(), &reply); err != nil {
+				logPeers.Warn("seed node is unreachable", "seed", other, "err", err)
+				continue
+			}
+			for _, b := range reply {
+				if validBeacon(b) {
+					s.add(b)
+				}
+			}
+		}
+		logPeers.Info("live peers", "count", len(s.live()))
+	}
+}
+
+// run a seed node at the given address
+func seedNode(addr string) {
+	initState()
+	applyGenesis()
+	signer = loadKey(keyFile, keyScheme) // only used for tls
+	s := &SeedNode{beacons: make(map[string]Beacon), ttl: seedTTL, others: seeds}
+	rpc.RegisterName("Seed", s)
+	ln, err := transport.Listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Seed node waiting for connection at " + ln.Addr().String())
+	go s.exchange()
+	openConnection(ln)
+}
+
+// register with every seed node a few times per ttl. if we have lost all our connections, we start over
+// from the peers the seed nodes know of
+func registerWithSeeds() {
+	for {
+		b := makeBeacon()
+		for _, seed := range seeds {
+			var reply bool
+			if err := callAny([]string{seed}, "Seed.Register", b, &reply); err != nil {
+				logPeers.Warn("could not register with seed node", "seed", seed, "err", err)
+			}
+		}
+		connsLock.Lock()
+		alone := len(conns) == 0
+		connsLock.Unlock()
+		if alone && bootstrapped.Load() {
+			bootstrapFrom(askSeeds())
+		}
+		time.Sleep(seedTTL / 3)
+	}
+}
+
+// ask the seed nodes for peers to connect to, in a random order
+func askSeeds() []Node {
+	var nodes []Node
+	known := make(map[string]bool)
+	for _, seed := range seeds {
+		var reply []Node
+		if err := callAny([]string{seed}, "Seed.GetPeers", seedPeers, &reply); err != nil {
+			logPeers.Warn("seed node is unreachable", "seed", seed, "err", err)
+			continue
+		}
+		for _, n := range reply {
+			if n.ID != myid && !known[n.ID] {
+				known[n.ID] = true
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	rngLock.Lock()
+	rng.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	rngLock.Unlock()
+	return nodes
+}
+
+// register a new connection, and start sending queued calls to it
+func addConnection(id string, conn *rpc.Client) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	conns[id] = conn
+	if old, exists := outboxes[id]; exists {
+		old.close()
+	}
+	outboxes[id] = MakeOutbox(id, conn)
+}
+
+// forget a connection that has failed, so the peer no longer counts as connected, and we notice when we are
+// alone. nothing happens if the connection has been replaced or removed in the meantime
+func dropConnection(id string, conn *rpc.Client, err error) {
+	connsLock.Lock()
+	if conns[id] != conn {
+		connsLock.Unlock()
+		return
+	}
+	outboxes[id].close()
+	conn.Close()
+	delete(outboxes, id)
+	delete(conns, id)
+	connsLock.Unlock()
+	peersLock.Lock()
+	if _, known := peers[id]; known {
+		peers[id] = false // still known, so we may connect to it again later
+	}
+	peersLock.Unlock()
+	logPeers.Warn("lost connection", "peer", id, "err", err)
+}
+
+// helper method, whether a call failed because of the connection. an error returned by the method itself
+// means the peer is still there
+func connectionFailed(err error) bool {
+	_, remote := err.(rpc.ServerError)
+	return err != nil && !remote
+}
+
+// report the state of the queue to every connection
+func (l *Listener) GetQueueStats(request bool, reply *[]QueueStats) error {
+	defer rpcCall("GetQueueStats")()
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	for _, o := range outboxes {
+		*reply = append(*reply, o.stats())
+	}
+	return nil
+}
+
+// the outbound queue to a single peer. the queued calls are sent with Client.Go by their own goroutine,
+// with up to maxInFlight calls waiting for a reply at a time. when the queue is full, new calls are dropped
+// right away, since the sender may be the applier or hold the pbft lock, and must never wait for a slow peer.
+// the dropped calls are counted, and the transactions among them reach the peer again through anti-entropy
+type Outbox struct {
+	peer      string
+	client    *rpc.Client
+	calls     chan outboundCall
+	inFlight  chan bool      // holds a value for every call waiting for its reply
+	done      chan *rpc.Call // replies of finished calls
+	stop      chan bool      // closed when the outbox is closed
+	highWater atomic.Int64   // the longest the queue has been
+	sent      atomic.Int64   // calls that got a reply
+	failed    atomic.Int64   // calls that returned an error
+	dropped   atomic.Int64   // calls dropped because the queue was full
+}
+
+type outboundCall struct {
+	method string
+	args   interface{}
+}
+
+// the state of the queue to a single peer
+type QueueStats struct {
+	Peer      string
+	Queued    int
+	InFlight  int
+	HighWater int64
+	Sent      int64
+	Failed    int64
+	Dropped   int64
+}
+
+const outboxSize = 256 // calls waiting to be sent to a peer
+const maxInFlight = 32 // calls to a peer waiting for their reply
+
+func MakeOutbox(peer string, client *rpc.Client) *Outbox {
+	o := new(Outbox)
+	o.peer = peer
+	o.client = client
+	o.calls = make(chan outboundCall, outboxSize)
+	o.inFlight = make(chan bool, maxInFlight)
+	o.done = make(chan *rpc.Call, maxInFlight)
+	o.stop = make(chan bool)
+	go o.send()
+	go o.receive()
+	return o
+}
+
+// queue a call, or drop it if the queue is full
+func (o *Outbox) enqueue(method string, args interface{}) {
+	select {
+	case o.calls <- outboundCall{method: method, args: args}:
+		n := int64(len(o.calls))
+		for {
+			high := o.highWater.Load()
+			if n <= high || o.highWater.CompareAndSwap(high, n) {
+				break
+			}
+		}
+	default:
+		o.dropped.Add(1)
+		logNet.Debug("queue is full, dropping a call", "peer", o.peer, "method", method)
+	}
+}
+
+// send the queued calls, without waiting for the replies
+func (o *Outbox) send() {
+	for {
+		select {
+		case c := <-o.calls:
+			select {
+			case o.inFlight <- true: // wait until there is room for another call
+			case <-o.stop:
+				return
+			}
+			o.client.Go(c.method, c.args, new(bool), o.done)
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// count the replies, making room for more calls
+func (o *Outbox) receive() {
+	for {
+		select {
+		case call := <-o.done:
+			<-o.inFlight
+			if call.Error != nil {
+				o.failed.Add(1)
+				if connectionFailed(call.Error) {
+					dropConnection(o.peer, o.client, call.Error)
+				}
+			} else {
+				o.sent.Add(1)
+			}
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// stop both goroutines. calls that are still queued are never sent. calls already handed to the client
+// finish on their own, or with an error once the caller closes the client
+func (o *Outbox) close() {
+	close(o.stop)
+}
+
+func (o *Outbox) stats() QueueStats {
+	return QueueStats{
+		Peer:      o.peer,
+		Queued:    len(o.calls),
+		InFlight:  len(o.inFlight),
+		HighWater: o.highWater.Load(),
+		Sent:      o.sent.Load(),
+		Failed:    o.failed.Load(),
+		Dropped:   o.dropped.Load(),
+	}
+}
+
+// the first call on a new connection. the caller must have started from the same genesis as us
+type Hello struct {
+	Genesis string
+	Node    Node
+	Nonce   []byte // signed by the callee, to prove it owns the key of its node id
+}
+
+// the reply to a hello
+type Welcome struct {
+	Node      Node
+	Key       string // our public key, encoded with encodeKey. its node id must be Node.ID
+	Signature []byte // signature on the nonce of the hello
+}
+
+// check that the caller started from the same genesis as us, and prove who we are
+func (l *Listener) Handshake(request Hello, reply *Welcome) error {
+	defer rpcCall("Handshake")()
+	record("Handshake", request)
+	if request.Genesis != genesisHash {
+		return errors.New("different genesis, expected " + genesisHash + " but got " + request.Genesis)
+	}
+	reply.Node = me()
+	reply.Key = encodeKey(signer.Public())
+	reply.Signature, _ = signWith(signer, nonceMessage(request.Nonce))
+	return nil
+}
+
+// helper method, performs the handshake on a new connection, and returns the node at the other end. an
+// address can change hands, so the node is only trusted if it signed our nonce with the key of its id
+func handshake(conn *rpc.Client) (Node, error) {
+	nonce := make([]byte, 16)
+	crand.Read(nonce)
+	var welcome Welcome
+	if err := conn.Call("Listener.Handshake", Hello{Genesis: genesisHash, Node: me(), Nonce: nonce}, &welcome); err != nil {
+		return Node{}, err
+	}
+	key, scheme, err := decodeKey(welcome.Key)
+	if err != nil {
+		return Node{}, err
+	}
+	if nodeID(key) != welcome.Node.ID || !scheme.Verify(key, nonceMessage(nonce), welcome.Signature) {
+		return Node{}, errors.New("the peer could not prove it is " + welcome.Node.ID)
+	}
+	record("Pin", map[string]string{welcome.Node.ID: welcome.Key})
+	mergeKeys(map[string]string{welcome.Node.ID: welcome.Key})
+	return welcome.Node, nil
+}
+
+// the hashed message that is signed in a handshake
+func nonceMessage(nonce []byte) []byte {
+	h := crypto.SHA256.New()
+	h.Write([]byte("handshake:"))
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// make the target connect to the given node. used to ensure bidirectional connections
+func (l *Listener) BiConnect(request Node, reply *bool) error {
+	defer rpcCall("BiConnect")()
+	record("BiConnect", request)
+	conn, err := dialNode(request)
+	if err != nil {
+		logPeers.Warn("could not connect back", "peer", request.ID, "err", err)
+		return err
+	}
+	learnNode(request)
+	logPeers.Info("bidirectional connection established", "peer", request.ID)
+	peersLock.Lock()
+	peers[request.ID] = true
+	peersLock.Unlock()
+	addConnection(request.ID, conn)
+	return nil
+}
+
+// create the loggers. called again once our node id is known, so every line carries it
+func initLogging() {
+	newLogger := func(subsystem string) *slog.Logger {
+		options := &slog.HandlerOptions{Level: logLevels[subsystem]}
+		var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+		if logJSON {
+			handler = slog.NewJSONHandler(os.Stderr, options)
+		}
+		logger := slog.New(handler).With("subsystem", subsystem)
+		if myid != "" {
+			logger = logger.With("node", myid)
+		}
+		return logger
+	}
+	logRPC = newLogger("rpc")
+	logPeers = newLogger("peers")
+	logLedger = newLogger("ledger")
+	logPbft = newLogger("pbft")
+	logNet = newLogger("net")
+}
+
+// set the levels of the subsystems from a list such as "rpc=debug,ledger=warn". a level without a
+// subsystem sets the level of all of them
+func setLogLevels(list string) error {
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, found := strings.Cut(part, "=")
+		if !found {
+			subsystem, name = "", part
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return err
+		}
+		if subsystem == "" {
+			for _, v := range logLevels {
+				v.Set(level)
+			}
+			continue
+		}
+		v, exists := logLevels[subsystem]
+		if !exists {
+			return errors.New("unknown subsystem " + subsystem + ", the subsystems are rpc, peers, ledger, pbft and net")
+		}
+		v.Set(level)
+	}
+	return nil
+}
+
+// tracing. every hop of a transaction or a new node through the network is recorded as a span, and the
+// span of the sender is sent along with the call, so the spans of all peers form the flood tree. the spans
+// are written as opentelemetry json, one export request per line, to a file that a collector can pick up.
+// a hop that arrives as a duplicate is recorded too, so redundant edges and slow peers both show up
+type SpanContext struct {
+	TraceID string // 16 bytes, hex encoded
+	SpanID  string // 8 bytes, hex encoded
+	Node    string // node id of the peer the span belongs to
+}
+
+type Span struct {
+	Context    SpanContext
+	Parent     *SpanContext
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+}
+
+var spanFile *os.File // where finished spans are written. nil when not tracing
+var finishedSpans []*Span
+var spansLock sync.Mutex
+
+const spanFlushInterval = time.Second
+
+// start a span, as a child of the given context. without a parent, a new trace is started. the ids are not
+// taken from the seeded random source, so tracing does not change what a seeded run does. returns nil when
+// not tracing, and every method of a nil span does nothing
+func startSpan(name string, parent *SpanContext, attributes ...string) *Span {
+	if spanFile == nil {
+		return nil
+	}
+	span := &Span{Parent: parent, Name: name, Start: time.Now(), Attributes: make(map[string]string)}
+	span.Context = SpanContext{TraceID: randomHex(16), SpanID: randomHex(8), Node: myid}
+	if parent != nil {
+		span.Context.TraceID = parent.TraceID
+		span.Attributes["from"] = parent.Node
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.Attributes[attributes[i]] = attributes[i+1]
+	}
+	return span
+}
+
+// the context to send along with our calls, so the spans of the callees become children of this one
+func (s *Span) context() *SpanContext {
+	if s == nil {
+		return nil
+	}
+	c := s.Context
+	return &c
+}
+
+// finish a span with the given outcome, and queue it to be written. a span is only finished once
+func (s *Span) end(outcome string) {
+	if s == nil {
+		return
+	}
+	spansLock.Lock()
+	defer spansLock.Unlock()
+	if !s.End.IsZero() {
+		return
+	}
+	s.End = time.Now()
+	s.Attributes["outcome"] = outcome
+	finishedSpans = append(finishedSpans, s)
+}
+
+// helper method, starts the span of a transaction at this hop, and makes it the context sent to the next hop
+func traceTransaction(st SignedTransaction, name string) SignedTransaction {
+	st.span = startSpan(name, st.Trace, "tx.id", st.T.ID)
+	st.Trace = st.span.context()
+	return st
+}
+
+// start writing spans to the given file
+func startSpans(file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spanFile = f
+	go func() {
+		for {
+			time.Sleep(spanFlushInterval)
+			flushSpans()
+		}
+	}()
+}
+
+// write the finished spans as a single opentelemetry export request
+func flushSpans() {
+	spansLock.Lock()
+	spans := finishedSpans
+	finishedSpans = nil
+	spansLock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	var out []interface{}
+	for _, s := range spans {
+		kind := 2 // server, a hop
+		if s.Parent == nil {
+			kind = 1 // internal, where the trace started
+		}
+		span := map[string]interface{}{
+			"traceId":           s.Context.TraceID,
+			"spanId":            s.Context.SpanID,
+			"name":              s.Name,
+			"kind":              kind,
+			"startTimeUnixNano": fmt.Sprint(s.Start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprint(s.End.UnixNano()),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.Parent != nil {
+			span["parentSpanId"] = s.Parent.SpanID
+		}
+		out = append(out, span)
+	}
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": otlpAttributes(map[string]string{"service.name": "peer", "node.id": myid})},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "peer"}, "spans": out}},
+		}},
+	}
+	b, _ := json.Marshal(request)
+	spanFile.Write(append(b, '\n'))
+}
+
+// helper method, attributes in the opentelemetry json encoding, sorted by key
+func otlpAttributes(attributes map[string]string) []interface{} {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, map[string]interface{}{"key": k, "value": map[string]string{"stringValue": attributes[k]}})
+	}
+	return out
+}
+
+// helper method, n random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// metrics, served in the prometheus text format with -metrics. counters are kept as things happen, the
+// rest is read from our state whenever the metrics are scraped
+type Metrics struct {
+	appliedTotal  atomic.Int64
+	lock          sync.Mutex
+	rejectedTotal map[string]int64      // by reason
+	calls         map[string]*callStats // by rpc method
+}
+
+// the latencies of the calls to a single rpc method
+type callStats struct {
+	buckets []int64 // calls that took at most the latency of the matching bucket
+	count   int64
+	sum     float64 // seconds
+}
+
+var metrics = &Metrics{rejectedTotal: make(map[string]int64), calls: make(map[string]*callStats)}
+
+var rejectReasons = []string{"bad_signature", "duplicate", "insufficient_funds", "mempool_full", "rules", "shared_account", "unpinned_key"}
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5} // seconds
+
+// helper method, counts a transaction that was not applied, and ends its span with the reason
+func reject(st SignedTransaction, reason string) {
+	metrics.rejected(reason)
+	st.span.end(reason)
+}
+
+// a copy of the counters that are protected by the lock
+func (m *Metrics) snapshot() (map[string]int64, map[string]callStats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rejected := make(map[string]int64, len(m.rejectedTotal))
+	for reason, n := range m.rejectedTotal {
+		rejected[reason] = n
+	}
+	calls := make(map[string]callStats, len(m.calls))
+	for method, c := range m.calls {
+		calls[method] = callStats{buckets: append([]int64{}, c.buckets...), count: c.count, sum: c.sum}
+	}
+	return rejected, calls
+}
+
+// count a transaction that was not applied
+func (m *Metrics) rejected(reason string) {
+	m.lock.Lock()
+	m.rejectedTotal[reason]++
+	m.lock.Unlock()
+}
+
+// count a call to an rpc method, and how long it took
+func (m *Metrics) observe(method string, d time.Duration) {
+	seconds := d.Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, exists := m.calls[method]
+	if !exists {
+		c = &callStats{buckets: make([]int64, len(latencyBuckets))}
+		m.calls[method] = c
+	}
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			c.buckets[i]++
+		}
+	}
+	c.count++
+	c.sum += seconds
+}
+
+// log an inbound call and time it. every rpc method starts with defer rpcCall(name)()
+func rpcCall(method string, args ...any) func() {
+	logRPC.Debug("called", append([]any{"method", method}, args...)...)
+	start := time.Now()
+	return func() {
+		metrics.observe(method, time.Since(start))
+	}
+}
+
+// serve the metrics over http at the given address, on /metrics
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Serving metrics at http://" + ln.Addr().String() + "/metrics")
+	go http.Serve(ln, mux)
+}
+
+// write every metric in the prometheus text format
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	describe := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	describe("ledger_transactions_applied_total", "counter", "Transactions applied to the ledger.")
+	fmt.Fprintf(w, "ledger_transactions_applied_total %d\n", metrics.appliedTotal.Load())
+	rejected, calls := metrics.snapshot() // every rpc call takes the lock, so it is not held while writing
+	describe("ledger_transactions_rejected_total", "counter", "Transactions that were not applied, by reason.")
+	for _, reason := range rejectReasons {
+		fmt.Fprintf(w, "ledger_transactions_rejected_total{reason=%q} %d\n", reason, rejected[reason])
+	}
+	methods := make([]string, 0, len(calls))
+	for method := range calls {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	describe("rpc_call_duration_seconds", "histogram", "Time spent handling inbound rpc calls, by method.")
+	for _, method := range methods {
+		c := calls[method]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "rpc_call_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, le, c.buckets[i])
+		}
+		fmt.Fprintf(w, "rpc_call_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, c.count)
+		fmt.Fprintf(w, "rpc_call_duration_seconds_sum{method=%q} %g\n", method, c.sum)
+		fmt.Fprintf(w, "rpc_call_duration_seconds_count{method=%q} %d\n", method, c.count)
+	}
+
+	ledger.lock.Lock()
+	height, supply, burned, total := len(ledger.history), ledger.supply, ledger.burned, 0
+	for _, balance := range ledger.Accounts {
+		total += balance
+	}
+	ledger.lock.Unlock()
+	describe("ledger_height", "gauge", "Transactions in the ledger history.")
+	fmt.Fprintf(w, "ledger_height %d\n", height)
+	describe("ledger_supply", "gauge", "All money ever created.")
+	fmt.Fprintf(w, "ledger_supply %d\n", supply)
+	describe("ledger_burned", "gauge", "Fees that were burned.")
+	fmt.Fprintf(w, "ledger_burned %d\n", burned)
+	describe("ledger_total_balance", "gauge", "The sum of all balances. Should be the supply minus the burned fees.")
+	fmt.Fprintf(w, "ledger_total_balance %d\n", total)
+	describe("mempool_size", "gauge", "Valid transactions waiting for funds.")
+	fmt.Fprintf(w, "mempool_size %d\n", len(mempool.contents()))
+
+	connsLock.Lock()
+	connections := len(conns)
+	stats := make([]QueueStats, 0, len(outboxes))
+	for _, o := range outboxes {
+		stats = append(stats, o.stats())
+	}
+	connsLock.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Peer < stats[j].Peer })
+	describe("peer_connections", "gauge", "Peers we are connected to.")
+	fmt.Fprintf(w, "peer_connections %d\n", connections)
+	describe("peer_known", "gauge", "Peers we know of, including ourselves.")
+	fmt.Fprintf(w, "peer_known %d\n", len(directory()))
+	describe("outbox_queued", "gauge", "Calls waiting to be sent to a peer.")
+	for _, q := range stats {
+		fmt.Fprintf(w, "outbox_queued{peer=%q} %d\n", q.Peer, q.Queued)
+	}
+	describe("outbox_dropped_total", "counter", "Calls dropped because the queue to a peer was full.")
+	for _, q := range stats {
+		fmt.Fprintf(w, "outbox_dropped_total{peer=%q} %d\n", q.Peer, q.Dropped)
+	}
+}
+
+// initialize all variables
+func initState() {
+	keys = make(map[string]string)
+	peers = make(map[string]bool)
+	addrs = make(map[string][]string)
+	nodes = make(map[string]Node)
+	conns = make(map[string]*rpc.Client)
+	outboxes = make(map[string]*Outbox)
+	pastTransactions = make(map[string]bool)
+	proposals = make(map[string]SignedTransaction)
+	tombstones = make(map[string]time.Time)
+	announced = make(map[string]int64)
+	discovered = make(map[string]Node)
+	ledger = MakeLedger()
+	mempool = MakeMempool()
+}
+
+func peer() {
+	initState()
+	go mempool.expire()
+	startPipeline(verifiers)
+	signer = loadKey(keyFile, keyScheme)
+	applyGenesis()
+	if genesis == nil {
+		logLedger.Warn("no genesis, so no account has any money")
+	}
+
+	// wait for input, and prepare for operation when received
+	if discoveryGroup != "" {
+		fmt.Println("Please enter the address of a peer, or nothing to look for peers on the lan")
+	} else {
+		fmt.Println("Please enter the address of a peer, or nothing to start a new network")
+	}
+	addr, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	addr = strings.TrimRight(addr, "\r\n") // os-independent way of removing newline characters
+	myid = nodeID(signer.Public())
+	listening := startServer()
+	myaddrs = []string{listening}
+	if advertise != "" {
+		myaddrs = strings.Split(advertise, ",")
+	}
+	myself = makeNode()
+	peersLock.Lock()
+	peers[myid] = true // by setting our own entry to true, we won't try to connect to it later
+	peersLock.Unlock()
+	initLogging()
+	fmt.Println("Our node id is " + myid + ", reachable at " + strings.Join(myaddrs, " "))
+	keysLock.Lock()
+	keys[myid] = encodeKey(signer.Public()) // add our own key to the keyset
+	keysLock.Unlock()
+	start := StartEntry{ID: myid, Key: encodeKey(signer.Public()), Genesis: genesisHash, Seed: seed}
+	if pbft != nil {
+		start.Replicas = pbft.replicas
+	}
+	record("Start", start)
+	if discoveryGroup != "" {
+		go sendBeacons()
+		go listenBeacons()
+	}
+	if len(seeds) > 0 {
+		go registerWithSeeds()
+	}
+	switch {
+	case addr != "":
+		connect(addr, true)
+	case len(seeds) > 0 && bootstrapFrom(askSeeds()):
+	case discoveryGroup != "":
+		fmt.Println("Looking for peers on the lan...")
+		bootstrapFrom(discover(2 * beaconInterval))
+	}
+	bootstrapped.Store(true)
+	go antiEntropy(antiEntropyInterval)
+	if pbft != nil {
+		go pbft.timer()
+	}
+
+	// handle transaction input
+	fmt.Println("Ready to handle transactions. The format is [peer] [amount] [fee], where the fee is optional. A peer is given by its node id, a prefix of it, or one of its addresses or ports. 'peers' lists all known peers.")
+	fmt.Println("Shared accounts: 'share [name] [amount] [threshold] [peer]...' creates one owned by the given peers, 'propose [name] [peer] [amount] [fee]' proposes a transfer from it, and 'approve [id]' signs a proposal. 'leave' leaves the network, start again with the same -key to rejoin. 'log [subsystem=level]...' changes what is logged.")
+	for {
+		msg, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		msg = strings.TrimRight(msg, "\n\r") // remove any trailing characters
+
+		s := strings.Split(msg, " ")
+		switch s[0] {
+		case "share": // [share, name, amount, threshold, owners...]
+			if len(s) < 5 {
+				fmt.Println("The format is share [name] [amount] [threshold] [peer]...")
+				continue
+			}
+			v, _ := strconv.Atoi(s[2])
+			threshold, _ := strconv.Atoi(s[3])
+			policy := &Policy{Threshold: threshold}
+			for _, owner := range s[4:] {
+				policy.Owners = append(policy.Owners, account(owner))
+			}
+			t := Transaction{ID: newID(), From: myid, To: s[1], Amount: v, Fee: rules.MinFee, Policy: policy}
+			st := SignedTransaction{T: t, Signature: sign(t)}
+			record("Local", st)
+			makeSignedTransaction(traceTransaction(st, "SubmitTransaction"))
+		case "propose": // [propose, name, to, amount, fee]
+			if len(s) < 4 {
+				fmt.Println("The format is propose [name] [peer] [amount] [fee]")
+				continue
+			}
+			v, _ := strconv.Atoi(s[3])
+			fee := rules.MinFee
+			if len(s) > 4 {
+				fee, _ = strconv.Atoi(s[4])
+			}
+			t := Transaction{ID: newID(), From: s[1], To: account(s[2]), Amount: v, Fee: fee}
+			fmt.Println("Proposing transaction " + t.ID)
+			st := SignedTransaction{T: t, Signatures: map[string][]byte{myid: sign(t)}}
+			record("LocalProposal", st)
+			proposeTransaction(st)
+		case "leave":
+			leave()
+		case "peers":
+			dir := directory()
+			for _, id := range getipset(peersIn(dir)) {
+				fmt.Println(id + " " + strings.Join(dir[id], " ") + connected(id))
+			}
+		case "log": // [log, subsystem=level...]
+			if err := setLogLevels(strings.Join(s[1:], ",")); err != nil {
+				fmt.Println(err)
+			}
+		case "approve": // [approve, id]
+			if len(s) < 2 {
+				fmt.Println("The format is approve [id]")
+				continue
+			}
+			var matches []SignedTransaction
+			proposalsLock.Lock()
+			for _, p := range proposals {
+				if p.T.ID == s[1] {
+					matches = append(matches, p)
+				}
+			}
+			proposalsLock.Unlock()
+			if len(matches) == 0 {
+				fmt.Println("Unknown proposal " + s[1])
+				continue
+			}
+			if len(matches) > 1 {
+				fmt.Println("There are " + fmt.Sprint(len(matches)) + " different proposals with the id " + s[1] + ", so none of them is approved")
+				continue
+			}
+			p := matches[0]
+			st := SignedTransaction{T: p.T, Signatures: map[string][]byte{myid: sign(p.T)}}
+			record("LocalProposal", st)
+			proposeTransaction(st)
+		default: // [to, amount, fee]
+			if len(s) < 2 {
+				fmt.Println("The format is [peer] [amount] [fee]")
+				continue
+			}
+			v, _ := strconv.Atoi(s[1]) // convert amount to int
+			fee := rules.MinFee        // pay the minimum fee, unless something else is given
+			if len(s) > 2 {
+				fee, _ = strconv.Atoi(s[2])
+			}
+			to := account(s[0])
+			from := myid // we can only send from ourselves (we do not know any other secret keys)
+			t := Transaction{ID: newID(), From: from, To: to, Amount: v, Fee: fee}
+
+			// broadcast the transaction
+			st := SignedTransaction{T: t, Signature: sign(t)}
+			record("Local", st)
+			makeSignedTransaction(traceTransaction(st, "SubmitTransaction"))
+		}
+	}
+}
+
+// generate a uuid for a transaction
+func newID() string {
+	b := make([]byte, 16)
+	rngLock.Lock()
+	rng.Read(b)
+	rngLock.Unlock()
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sign a transaction with our own key
+func sign(t Transaction) []byte {
+	signature, _ := signWith(signer, hashMessage(t))
+	return signature
+}
+
+// turn user input into an account: a node id, a unique prefix of one, with or without its scheme, or an
+// address or port of a known peer. anything else is the name of a shared account
+func account(s string) string {
+	peersLock.Lock()
+	_, known := peers[s]
+	peersLock.Unlock()
+	if known || s == myid {
+		return s
+	}
+	var matches []string
+	for id, as := range directory() {
+		_, hash, _ := strings.Cut(id, ":")
+		if len(s) >= 4 && (strings.HasPrefix(id, s) || strings.HasPrefix(hash, s)) {
+			matches = append(matches, id)
+			continue
+		}
+		for _, a := range as {
+			if a == s || strings.HasSuffix(a, ":"+s) {
+				matches = append(matches, id)
+				break
+			}
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	if len(matches) > 1 {
+		fmt.Println(s + " matches several peers, using it as the name of a shared account")
+	}
+	return s
+}
+
+// the id of a node: the name of the scheme of its public key, and the first half of the sha256 hash of the
+// key, such as ed25519:3f0c.... since the id follows from the key, nobody can take over the id of another
+// node, and a node keeps its id when its address changes. the scheme tells how the account signs
+func nodeID(key crypto.PublicKey) string {
+	scheme, err := schemeOf(key)
+	if err != nil {
+		return ""
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	h := crypto.SHA256.New()
+	h.Write(der)
+	return scheme.Name() + ":" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// connect to a server at the given address that may not be active. returns whether a new connection was made
+func connect(remote string, recursive bool) bool {
+	// recursively connect to the targets set of connections
+	recConnect := func(connections map[string]Node) {
+		others := make(map[string]bool)
+		for id := range connections {
+			if id != myid {
+				others[id] = true
+			}
+		}
+		ids := getipset(others) // get the keyset of peers
+		n := 0                  // successes
+		m := 0                  // attempts
+		for float64(n) < math.Min(2.0, float64(len(ids))) && m < 99 {
+			rngLock.Lock()
+			r := rng.Intn(len(ids)) // roll a dice
+			rngLock.Unlock()
+			if !isConnected(ids[r]) { // if we are not connected to this guy
+				connectNode(connections[ids[r]], false) // connect to him non-recursively
+				n += 1
+			} else {
+				m += 1
+			}
+		}
+	}
+
+	conn, err := dial(remote)
+	if err == nil {
+		node, err := handshake(conn)
+		if err != nil {
+			logPeers.Warn("rejected", "addr", remote, "err", err)
+			conn.Close()
+			return false
+		}
+		peersLock.Lock()
+		known := node.ID == myid || peers[node.ID]
+		if !known {
+			peers[node.ID] = true // claimed right away, so a concurrent connect to another of its addresses backs off
+		}
+		peersLock.Unlock()
+		if known {
+			conn.Close() // ourselves, or someone we are connected to, at another address
+			return false
+		}
+		learnNode(node)
+		addConnection(node.ID, conn)
+		remotePeers := make(map[string]Node)  // remote peer directory
+		remoteKeys := make(map[string]string) // remote key set
+		var reply bool
+		conn.Call("Listener.Rejoin", announce(false), &reply) // in case we have left before
+		span := startSpan("Join", nil, "addr", remote)
+		announcement := me()
+		announcement.Trace = span.context()
+		conn.Call("Listener.BroadcastNewNode", announcement, &reply)
+		span.end("announced")
+		conn.Call("Listener.MergePeers", signedDirectory(), &remotePeers)
+		conn.Call("Listener.MergeKeys", keys, &remoteKeys)
+		record("MergeKeysReply", remoteKeys)
+		mergeKeys(remoteKeys) // the keys are needed to validate the history
+		remoteHistory := []SignedTransaction{}
+		conn.Call("Listener.SyncHistory", ledger.getHistory(), &remoteHistory)
+		record("SyncHistoryReply", remoteHistory)
+		replayHistory(remoteHistory)
+		conn.Call("Listener.BiConnect", me(), &reply)
+		if recursive {
+			recConnect(remotePeers)
+		}
+		mergePeers(remotePeers)
+		logPeers.Info("connected", "peer", node.ID, "addr", remote)
+		return true
+	}
+	logPeers.Info("no peer at address", "addr", remote)
+	return false
+}
+
+// connect to a node, trying each of its addresses until one works
+func connectNode(n Node, recursive bool) bool {
+	for _, a := range n.Addrs {
+		if connect(a, recursive) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper method, the set of peers in a peer directory, except ourselves
+func peersIn(dir map[string][]string) map[string]bool {
+	ps := make(map[string]bool)
+	for id := range dir {
+		if id != myid {
+			ps[id] = true
+		}
+	}
+	return ps
+}
+
+// helper method, marks the peers we are connected to in the output of the peers command
+func connected(id string) string {
+	if isConnected(id) {
+		return " (connected)"
+	}
+	return ""
+}
+
+// helper method, whether we are connected to the peer
+func isConnected(id string) bool {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	return peers[id]
+}
+
+// start our own server, and return the address it listens on
+func startServer() string {
+	ln, err := transport.Listen(listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Server waiting for connection at " + ln.Addr().String())
+
+	// handle incoming method calls
+	listener := new(Listener)
+	rpc.Register(listener)
+	go openConnection(ln)
+	return ln.Addr().String()
 }
 
 // listen for incoming rpc connections
 func openConnection(ln net.Listener) {
-	fmt.Println("Waiting for connection...")
 	rpc.Accept(ln)     // wait for connection
 	openConnection(ln) // go wait for further connections
 }
 
-func getipset(c map[string]bool) []string {
-	var ips []string
-	for k, _ := range c {
-		ips = append(ips, k)
+// a transport creates the connections between peers
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var transport Transport = tcpTransport{}
+
+// connect to the rpc server at the given address, using the configured transport
+func dial(addr string) (*rpc.Client, error) {
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// connect to a node at the first of its addresses that answers, and check that it really is the node
+func dialNode(n Node) (*rpc.Client, error) {
+	err := errors.New(n.ID + " has no known address")
+	for _, a := range n.Addrs {
+		var conn *rpc.Client
+		conn, err = dial(a)
+		if err != nil {
+			continue
+		}
+		var remote Node
+		remote, err = handshake(conn)
+		if err == nil && remote.ID != n.ID {
+			err = errors.New(a + " is " + remote.ID + ", not " + n.ID)
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+	return nil, err
+}
+
+// plain, unauthenticated tcp
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// mutually authenticated tls. every peer presents a self-signed certificate for its own key, with its
+// node id as the common name. a certificate is only accepted if the node id is the id of its key, so a
+// peer cannot present a certificate for another node. which node is at the other end of an address is
+// checked by the handshake, since addresses can change hands
+type tlsTransport struct {
+	once sync.Once
+	cert tls.Certificate
+}
+
+// helper method, our certificate. it is made on first use, since the benchmark dials without ever listening
+func (t *tlsTransport) certificate() tls.Certificate {
+	t.once.Do(func() {
+		t.cert = makeCertificate(signer, nodeID(signer.Public()))
+	})
+	return t.cert
+}
+
+func (t *tlsTransport) Dial(addr string) (net.Conn, error) {
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{t.certificate()},
+		InsecureSkipVerify:    true, // there is no certificate authority, so we verify the certificate ourselves
+		VerifyPeerCertificate: verifyPeer,
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{t.certificate()},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifyPeer,
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// create a self-signed certificate for the given key
+func makeCertificate(key crypto.Signer, name string) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(crand.Reader, template, template, key.Public(), key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// verify the certificate of a peer. the certificate must be issued to the node id of its own key
+func verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return err // not properly self-signed
+	}
+	if _, err := schemeOf(cert.PublicKey); err != nil {
+		return err
+	}
+	id := cert.Subject.CommonName
+	if id != nodeID(cert.PublicKey) {
+		return errors.New("certificate was issued to " + id + ", which is not the node id of its key")
+	}
+	key := encodeKey(cert.PublicKey)
+	record("Pin", map[string]string{id: key})
+	mergeKeys(map[string]string{id: key})
+	return nil
+}
+
+// a simulated network on top of another transport. every write is delayed by the latency and jitter of
+// its link, and partitions cut links off. since peers talk over tcp, a lost packet is never really lost,
+// it is retransmitted after a timeout, so loss shows up as extra delay. all randomness comes from the
+// seed of the scenario, so a run can be repeated
+type simTransport struct {
+	inner    Transport
+	scenario *Scenario
+	local    string         // the address we listen on, used to identify our links
+	links    map[string]int // number of connections made on every link, used to seed them
+	lock     sync.Mutex
+}
+
+// the network conditions of a simulation, loaded from a json file
+type Scenario struct {
+	Seed    int64
+	Epoch   int64        // unix time the events are relative to. if 0, the time the peer started
+	Default LinkConfig   // conditions of links that are not listed
+	Links   []LinkConfig // conditions of specific links
+	Events  []SimEvent   // partitions and heals, in order
+	start   time.Time
+}
+
+type LinkConfig struct {
+	From    string  // address of the sending peer
+	To      string  // address of the receiving peer
+	Latency string  // e.g. "50ms"
+	Jitter  string  // the latency varies by up to this much in both directions
+	Loss    float64 // probability that a packet is lost and has to be retransmitted
+}
+
+type SimEvent struct {
+	At        string     // time since the epoch, e.g. "10s"
+	Partition [][]string // groups of addresses that can only reach their own group. peers not listed reach everyone
+	Heal      bool       // remove the partition
+}
+
+const retransmitTimeout = 200 * time.Millisecond
+
+var errPartitioned = errors.New("the network is partitioned")
+
+// load a scenario from a json file
+func loadScenario(file string) (*Scenario, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sc := new(Scenario)
+	if err := json.Unmarshal(b, sc); err != nil {
+		return nil, err
+	}
+	sc.start = time.Now()
+	if sc.Epoch != 0 {
+		sc.start = time.Unix(sc.Epoch, 0)
+	}
+	for _, e := range sc.Events {
+		if _, err := time.ParseDuration(e.At); err != nil {
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+// the configuration of the link from one peer to another
+func (sc *Scenario) link(from string, to string) LinkConfig {
+	for _, l := range sc.Links {
+		if l.From == from && l.To == to {
+			return l
+		}
+	}
+	return sc.Default
+}
+
+// whether two peers are in different groups of the current partition
+func (sc *Scenario) partitioned(a string, b string) bool {
+	elapsed := time.Since(sc.start)
+	var groups [][]string
+	for _, e := range sc.Events {
+		at, _ := time.ParseDuration(e.At)
+		if at > elapsed {
+			break
+		}
+		groups = e.Partition
+		if e.Heal {
+			groups = nil
+		}
+	}
+	ga, gb := -1, -1
+	for i, group := range groups {
+		for _, addr := range group {
+			if addr == a {
+				ga = i
+			}
+			if addr == b {
+				gb = i
+			}
+		}
+	}
+	return ga != -1 && gb != -1 && ga != gb
+}
+
+func newSimTransport(inner Transport, sc *Scenario) *simTransport {
+	return &simTransport{inner: inner, scenario: sc, links: make(map[string]int)}
+}
+
+func (t *simTransport) Dial(addr string) (net.Conn, error) {
+	addr = formatAddr(addr)
+	if t.scenario.partitioned(t.local, addr) {
+		return nil, errPartitioned
+	}
+	conn, err := t.inner.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.Write([]byte(t.local + "\n")) // tell the other end who we are, so it knows which link this is
+	return t.wrap(conn, addr), nil
+}
+
+func (t *simTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	t.local = formatAddr(ln.Addr().String())
+	l := &simListener{Listener: ln, transport: t, accepted: make(chan net.Conn), done: make(chan bool)}
+	go l.acceptAll()
+	return l, nil
+}
+
+// the links of a scenario are named by the addresses of their ends, so every address of a local peer is
+// written the same way
+func formatAddr(addr string) string {
+	addr = strings.ReplaceAll(addr, "localhost", "[::]")
+	addr = strings.ReplaceAll(addr, "127.0.0.1", "[::]")
+	return addr
+}
+
+// give a connection the conditions of its link. every connection gets its own random source, seeded by
+// the seed of the scenario, the link, and how many connections the link has had before
+func (t *simTransport) wrap(conn net.Conn, remote string) net.Conn {
+	t.lock.Lock()
+	name := t.local + ">" + remote
+	t.links[name]++
+	h := crypto.SHA256.New()
+	h.Write([]byte(name + "#" + fmt.Sprint(t.links[name])))
+	seed := t.scenario.Seed
+	for _, b := range h.Sum(nil)[:8] {
+		seed = seed*31 + int64(b)
+	}
+	t.lock.Unlock()
+	c := &simConn{
+		Conn:     conn,
+		scenario: t.scenario,
+		local:    t.local,
+		remote:   remote,
+		config:   t.scenario.link(t.local, remote),
+		rng:      rand.New(rand.NewSource(seed)),
+		packets:  make(chan simPacket, 1024),
+		closed:   make(chan bool),
+	}
+	go c.deliver()
+	return c
+}
+
+type simListener struct {
+	net.Listener
+	transport *simTransport
+	accepted  chan net.Conn // connections whose first line has been read
+	done      chan bool     // closed when the listener fails
+	err       error         // why the listener failed
+}
+
+const simHandshakeTimeout = 5 * time.Second // how long a new connection may take to say which peer it comes from
+
+// return the next connection that has said which peer it comes from
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// accept connections, and read which peer each comes from on its own, so a connection that says nothing
+// does not hold up the others
+func (l *simListener) acceptAll() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// helper method, read which peer a connection comes from. connections across a partition are refused
+func (l *simListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(simHandshakeTimeout))
+	remote, err := readLine(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || l.transport.scenario.partitioned(l.transport.local, remote) {
+		conn.Close()
+		return
+	}
+	c := l.transport.wrap(conn, remote)
+	select {
+	case l.accepted <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// read a line one byte at a time, so nothing after the newline is consumed
+func readLine(conn net.Conn) (string, error) {
+	line := ""
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line += string(b)
+	}
+}
+
+// a connection on a simulated link. writes are queued, and delivered in order once their delay has passed
+type simConn struct {
+	net.Conn
+	scenario *Scenario
+	local    string
+	remote   string
+	config   LinkConfig
+	rng      *rand.Rand
+	packets  chan simPacket
+	last     time.Time // delivery time of the latest packet, packets are never delivered out of order
+	lock     sync.Mutex
+	closed   chan bool
+	once     sync.Once
+}
+
+type simPacket struct {
+	data []byte
+	at   time.Time
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	if c.scenario.partitioned(c.local, c.remote) {
+		c.Close()
+		return 0, errPartitioned
+	}
+	c.lock.Lock()
+	at := time.Now().Add(c.delay())
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+	c.lock.Unlock()
+	select {
+	case c.packets <- simPacket{data: append([]byte{}, b...), at: at}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// the delay of a packet: the latency, some jitter, and a retransmission timeout for every time it is lost
+func (c *simConn) delay() time.Duration {
+	latency, _ := time.ParseDuration(c.config.Latency)
+	jitter, _ := time.ParseDuration(c.config.Jitter)
+	d := latency
+	if jitter > 0 {
+		d += time.Duration(c.rng.Int63n(int64(2*jitter))) - jitter
+	}
+	for c.rng.Float64() < c.config.Loss {
+		d += retransmitTimeout
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// deliver the queued packets when their time has come
+func (c *simConn) deliver() {
+	for {
+		select {
+		case p := <-c.packets:
+			time.Sleep(time.Until(p.at))
+			if c.scenario.partitioned(c.local, c.remote) {
+				c.Close()
+				return
+			}
+			if _, err := c.Conn.Write(p.data); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *simConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func getipset(c map[string]bool) []string {
+	var ips []string
+	for k, _ := range c {
+		ips = append(ips, k)
+	}
+	sort.Strings(ips) // the order of a map changes from run to run, so sort it to make the dice rolls repeatable
+	return ips
+}
+
+type Ledger struct {
+	Accounts map[string]int
+	Policies map[string]Policy // the owners of every shared account
+	lock     sync.Mutex
+	history  []SignedTransaction   // every applied transaction, in the order we applied them
+	supply   int                   // all money ever created, by the genesis
+	burned   int                   // fees that were not credited to anyone
+	root     []byte                // merkle root of the accounts, updated whenever a balance changes
+	nodes    map[treeNode][32]byte // the hash of every non-empty node of the tree, so a change only rehashes its path
+}
+
+func MakeLedger() *Ledger {
+	ledger := new(Ledger)
+	ledger.Accounts = make(map[string]int)
+	ledger.Policies = make(map[string]Policy)
+	ledger.nodes = make(map[treeNode][32]byte)
+	ledger.updateRoot()
+	return ledger
+}
+
+// update the tree after the balances of the given accounts changed, and recompute the root. the accounts are
+// stored in a sparse merkle tree: every account has a leaf at the position given by the hash of its name, and
+// all other leaves are empty. only the nodes on the path of a changed leaf are rehashed. the root only depends
+// on the balances, so peers with the same balances always end up with the same root. the lock must be held
+func (l *Ledger) updateRoot(accounts ...string) {
+	for _, account := range accounts {
+		node := treeNode{prefix: treePath(account)}
+		balance, exists := l.Accounts[account]
+		h, empty := emptyHashes[0], !exists
+		if exists {
+			h = leafHash(account, balance)
+			l.nodes[node] = h
+		} else {
+			delete(l.nodes, node)
+		}
+		for height := 1; height <= treeDepth; height++ {
+			bit := treeDepth - height
+			sibling := treeNode{height: height - 1, prefix: flipBit(node.prefix, bit)}
+			siblingHash, stored := l.nodes[sibling] // empty subtrees are never stored
+			if !stored {
+				siblingHash = emptyHashes[height-1]
+			}
+			parent := treeNode{height: height, prefix: clearBit(node.prefix, bit)}
+			empty = empty && !stored
+			switch {
+			case empty:
+				h = emptyHashes[height]
+				delete(l.nodes, parent)
+			case pathBit(node.prefix, bit) == 0:
+				h = nodeHash(h, siblingHash)
+				l.nodes[parent] = h
+			default:
+				h = nodeHash(siblingHash, h)
+				l.nodes[parent] = h
+			}
+			node = parent
+		}
+	}
+	root, stored := l.nodes[treeNode{height: treeDepth}]
+	if !stored {
+		root = emptyHashes[treeDepth]
+	}
+	l.root = root[:]
+}
+
+// create a proof of the balance of an account, which can be checked against our root without knowing
+// any other account. the lock must be held
+func (l *Ledger) prove(account string) BalanceProof {
+	balance, exists := l.Accounts[account]
+	proof := BalanceProof{Account: account, Balance: balance, Exists: exists, Siblings: make([][]byte, treeDepth)}
+	prefix := treePath(account)
+	for height := 1; height <= treeDepth; height++ {
+		// empty subtrees are not stored, so they are left out of the proof. the verifier knows their hash
+		bit := treeDepth - height
+		if h, stored := l.nodes[treeNode{height: height - 1, prefix: flipBit(prefix, bit)}]; stored {
+			proof.Siblings[height-1] = h[:]
+		}
+		prefix = clearBit(prefix, bit)
+	}
+	return proof
+}
+
+const treeDepth = 256 // one level for every bit of a sha256 hash
+
+// the hash of an empty subtree of every height, where a single leaf has height 0
+var emptyHashes = makeEmptyHashes()
+
+// a node of the tree: its height, and the path to it. the bits of the path below the node are zero
+type treeNode struct {
+	height int
+	prefix [32]byte
+}
+
+// a balance, together with the hashes needed to recompute the root from it
+type BalanceProof struct {
+	Account  string
+	Balance  int
+	Exists   bool     // false if the account has no leaf in the tree. the proof then shows the leaf is empty
+	Siblings [][]byte // the sibling of the path from the leaf to the root at every height. empty if the sibling is an empty subtree
+	Root     SignedRoot
+}
+
+// a root of the tree, signed by the peer that computed it
+type SignedRoot struct {
+	Root      []byte
+	Height    int    // number of transactions applied to get this root
+	Signer    string // the account of the peer
+	Signature []byte
+}
+
+// check that the proof leads to the given root
+func (p BalanceProof) verify(root []byte) bool {
+	if len(p.Siblings) != treeDepth {
+		return false
+	}
+	h := emptyHashes[0]
+	if p.Exists {
+		h = leafHash(p.Account, p.Balance)
+	} else if p.Balance != 0 {
+		return false
+	}
+	path := treePath(p.Account)
+	for height := 1; height <= treeDepth; height++ {
+		sibling := emptyHashes[height-1]
+		if len(p.Siblings[height-1]) > 0 {
+			if len(p.Siblings[height-1]) != len(sibling) {
+				return false
+			}
+			copy(sibling[:], p.Siblings[height-1])
+		}
+		if pathBit(path, treeDepth-height) == 0 {
+			h = nodeHash(h, sibling)
+		} else {
+			h = nodeHash(sibling, h)
+		}
+	}
+	return bytes.Equal(h[:], root)
+}
+
+func makeEmptyHashes() [][32]byte {
+	hashes := make([][32]byte, treeDepth+1)
+	hashes[0] = sha256.Sum256(nil)
+	for i := 1; i <= treeDepth; i++ {
+		hashes[i] = nodeHash(hashes[i-1], hashes[i-1])
+	}
+	return hashes
+}
+
+// the prefix of a node is the prefix of its child with one more bit cleared, so the path from a leaf to the
+// root is walked by clearing one bit at every level
+func clearBit(path [32]byte, bit int) [32]byte {
+	path[bit/8] &^= 1 << (7 - bit%8)
+	return path
+}
+
+func flipBit(path [32]byte, bit int) [32]byte {
+	path[bit/8] ^= 1 << (7 - bit%8)
+	return path
+}
+
+func treePath(account string) [32]byte {
+	h := crypto.SHA256.New()
+	h.Write([]byte(account))
+	var path [32]byte
+	copy(path[:], h.Sum(nil))
+	return path
+}
+
+func pathBit(path [32]byte, bit int) byte {
+	return (path[bit/8] >> (7 - bit%8)) & 1
+}
+
+// leaves and inner nodes are hashed differently, so one can not pass as the other. the hashes are arrays,
+// so the hundreds of them made for every changed balance need no allocations
+func leafHash(account string, balance int) [32]byte {
+	return sha256.Sum256([]byte("\x00" + account + "=" + fmt.Sprint(balance)))
+}
+
+func nodeHash(left [32]byte, right [32]byte) [32]byte {
+	var b [65]byte
+	b[0] = 1
+	copy(b[1:], left[:])
+	copy(b[33:], right[:])
+	return sha256.Sum256(b[:])
+}
+
+// a copy of the transaction history, safe to send to other peers
+func (l *Ledger) getHistory() []SignedTransaction {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]SignedTransaction{}, l.history...)
+}
+
+// transactions that are valid, but cannot be funded by the sender yet. this happens when a transaction
+// arrives before the transaction funding it. they are retried whenever balances change, and dropped
+// once they have waited for longer than the timeout. an unfunded transaction costs nothing to make, so
+// the number of waiting transactions is limited, in total and for every sender
+type Mempool struct {
+	pending  map[string]pendingTransaction // transaction id to transaction
+	bySender map[string]map[string]bool    // sender to the ids of its waiting transactions
+	lock     sync.Mutex
+}
+
+type pendingTransaction struct {
+	st    SignedTransaction
+	added time.Time
+}
+
+func MakeMempool() *Mempool {
+	mempool := new(Mempool)
+	mempool.pending = make(map[string]pendingTransaction)
+	mempool.bySender = make(map[string]map[string]bool)
+	return mempool
+}
+
+const mempoolSize = 10000    // transactions waiting for funds
+const mempoolPerSender = 100 // transactions of a single sender waiting for funds
+
+// add a transaction, unless it is already waiting. it is rejected if there is no room for it
+func (m *Mempool) add(st SignedTransaction) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.pending[st.T.ID]; exists {
+		return
+	}
+	from := st.T.From
+	if len(m.pending) >= mempoolSize || len(m.bySender[from]) >= mempoolPerSender {
+		logLedger.Info("rejected", "tx", st.T.ID, "reason", "too many transactions are waiting for funds", "from", from)
+		reject(st, "mempool_full")
+		return
+	}
+	m.pending[st.T.ID] = pendingTransaction{st: st, added: time.Now()}
+	if m.bySender[from] == nil {
+		m.bySender[from] = make(map[string]bool)
+	}
+	m.bySender[from][st.T.ID] = true
+	logLedger.Debug("waiting for funds", "tx", st.T.ID)
+}
+
+func (m *Mempool) remove(id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.delete(id)
+}
+
+// helper method. the lock must be held
+func (m *Mempool) delete(id string) {
+	p, exists := m.pending[id]
+	if !exists {
+		return
+	}
+	delete(m.pending, id)
+	delete(m.bySender[p.st.T.From], id)
+	if len(m.bySender[p.st.T.From]) == 0 {
+		delete(m.bySender, p.st.T.From)
+	}
+}
+
+// the waiting transactions of a sender, oldest first
+func (m *Mempool) from(account string) []SignedTransaction {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sorted := make([]pendingTransaction, 0, len(m.bySender[account]))
+	for id := range m.bySender[account] {
+		sorted = append(sorted, m.pending[id])
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].added.Before(sorted[j].added) })
+	sts := make([]SignedTransaction, len(sorted))
+	for i, p := range sorted {
+		sts[i] = p.st
+	}
+	return sts
+}
+
+// the waiting transactions, oldest first
+func (m *Mempool) contents() []SignedTransaction {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sorted := make([]pendingTransaction, 0, len(m.pending))
+	for _, p := range m.pending {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].added.Before(sorted[j].added) })
+	sts := make([]SignedTransaction, len(sorted))
+	for i, p := range sorted {
+		sts[i] = p.st
+	}
+	return sts
+}
+
+// try to apply the waiting transactions of the given accounts again, since their balances have grown. every
+// transaction applied this way grows other balances, whose senders are tried next. the waiting transactions
+// have already been checked, so they are applied directly. ones that were applied some other way in the
+// meantime are dropped, without counting them as rejected
+func (m *Mempool) retry(accounts ...string) {
+	for len(accounts) > 0 {
+		account := accounts[0]
+		accounts = accounts[1:]
+		for _, st := range m.from(account) {
+			ledger.lock.Lock()
+			done := pastTransactions[st.T.ID]
+			ledger.lock.Unlock()
+			if done {
+				m.remove(st.T.ID)
+				continue
+			}
+			if settleTransaction(st) {
+				accounts = append(accounts, credited(st.T)...)
+			}
+		}
+	}
+}
+
+// drop transactions that have waited for too long
+func (m *Mempool) expire() {
+	for {
+		time.Sleep(time.Second)
+		m.lock.Lock()
+		for id, p := range m.pending {
+			if time.Since(p.added) > mempoolTimeout {
+				m.delete(id)
+				logLedger.Debug("expired while waiting for funds", "tx", id)
+				reject(p.st, "insufficient_funds")
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+// the initial state of the network, signed by an authority
+type Genesis struct {
+	Accounts  []GenesisAccount
+	Rules     Rules
+	Authority string // public key of the authority, base64 encoded
+	Signature string // signature of the authority on the hash of the genesis, base64 encoded
+}
+
+// rules every transaction must follow. they are part of the genesis, so all peers agree on them
+type Rules struct {
+	MinFee            int    // smallest fee a transaction must pay
+	MaxAmount         int    // largest amount a single transaction may transfer. 0 means no limit
+	FeeAccount        string // account credited with the fees. if empty, the fees are burned
+	AllowSelfTransfer bool   // whether an account may send money to itself
+}
+
+type GenesisAccount struct {
+	Account string  // node id of the account, or the name of a shared account
+	Key     string  // public key owning the account, base64 encoded. if given, the account must be its node id
+	Policy  *Policy `json:",omitempty"` // makes the account a shared account instead of an account owned by a key
+	Balance int
+}
+
+// the owners of a shared account. a transaction from the account must be signed by at least Threshold of them
+type Policy struct {
+	Threshold int
+	Owners    []string // the accounts whose keys may sign for the shared account
+}
+
+// the hash of everything in the genesis except the signature
+func (g *Genesis) hash() []byte {
+	unsigned := Genesis{Accounts: g.Accounts, Rules: g.Rules, Authority: g.Authority}
+	b, _ := json.Marshal(unsigned)
+	h := crypto.SHA256.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// load a genesis file and verify the signature of its authority
+func loadGenesis(file string) (*Genesis, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	g := new(Genesis)
+	if err := json.Unmarshal(b, g); err != nil {
+		return nil, err
+	}
+	authority, scheme, err := decodeKey(g.Authority)
+	if err != nil {
+		return nil, errors.New("invalid authority key: " + err.Error())
+	}
+	signature, err := base64.StdEncoding.DecodeString(g.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !scheme.Verify(authority, g.hash(), signature) {
+		return nil, errors.New("the genesis is not signed by its authority")
+	}
+	for _, a := range g.Accounts {
+		if a.Key == "" {
+			continue
+		}
+		key, _, err := decodeKey(a.Key)
+		if err != nil {
+			return nil, errors.New("invalid key for " + a.Account + ": " + err.Error())
+		}
+		if nodeID(key) != a.Account {
+			return nil, errors.New("the key for " + a.Account + " has node id " + nodeID(key))
+		}
+	}
+	return g, nil
+}
+
+// read an unsigned genesis, sign it with the given authority key, and print the result
+func signGenesis(file string, authority crypto.Signer) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	g := new(Genesis)
+	if err := json.Unmarshal(b, g); err != nil {
+		return err
+	}
+	g.Authority = encodeKey(authority.Public())
+	signature, err := signWith(authority, g.hash())
+	if err != nil {
+		return err
+	}
+	g.Signature = base64.StdEncoding.EncodeToString(signature)
+	out, _ := json.MarshalIndent(g, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+// set up the ledger and pin the keys listed in the genesis
+func applyGenesis() {
+	if genesis == nil {
+		genesisHash = "none"
+		return
+	}
+	genesisHash = hex.EncodeToString(genesis.hash())
+	rules = genesis.Rules
+	for _, a := range genesis.Accounts {
+		ledger.Accounts[a.Account] += a.Balance
+		ledger.supply += a.Balance
+		if a.Policy != nil {
+			ledger.Policies[a.Account] = *a.Policy
+		}
+		if a.Key != "" {
+			key, _, _ := decodeKey(a.Key) // already validated when loading
+			keys[a.Account] = encodeKey(key)
+		}
+		ledger.updateRoot(a.Account)
+	}
+	logLedger.Info("using genesis", "hash", genesisHash)
+}
+
+// load our key from a pem file, or generate a new one of the given scheme and store it there
+func loadKey(file string, scheme Scheme) crypto.Signer {
+	if file == "" {
+		key, _ := scheme.Generate()
+		return key
+	}
+	b, err := os.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			log.Fatal("no pem data in " + file)
+		}
+		if block.Type == "RSA PRIVATE KEY" { // files written before other schemes were supported
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return key
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, ok := key.(crypto.Signer)
+		if !ok {
+			log.Fatal("the key in " + file + " cannot sign")
+		}
+		return s
+	}
+	key, _ := scheme.Generate()
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// a signature scheme. every encoded key starts with the name of its scheme, e.g. "ed25519:MCowBQYDK2VwAyEA..."
+type Scheme interface {
+	Name() string
+	Generate() (crypto.Signer, error)
+	Sign(key crypto.Signer, hm []byte) ([]byte, error)
+	Verify(key crypto.PublicKey, hm []byte, signature []byte) bool
+}
+
+var schemes = map[string]Scheme{
+	"rsa":     rsaScheme{},
+	"ecdsa":   ecdsaScheme{},
+	"ed25519": ed25519Scheme{},
+}
+
+// rsa-pss over sha256, with 2048 bit keys
+type rsaScheme struct{}
+
+func (rsaScheme) Name() string { return "rsa" }
+
+func (rsaScheme) Generate() (crypto.Signer, error) {
+	return rsa.GenerateKey(crand.Reader, 2048)
+}
+
+func (rsaScheme) Sign(key crypto.Signer, hm []byte) ([]byte, error) {
+	return key.Sign(crand.Reader, hm, &rsa.PSSOptions{Hash: crypto.SHA256})
+}
+
+func (rsaScheme) Verify(key crypto.PublicKey, hm []byte, signature []byte) bool {
+	k, ok := key.(*rsa.PublicKey)
+	return ok && rsa.VerifyPSS(k, crypto.SHA256, hm, signature, nil) == nil
+}
+
+// ecdsa on the p-256 curve
+type ecdsaScheme struct{}
+
+func (ecdsaScheme) Name() string { return "ecdsa" }
+
+func (ecdsaScheme) Generate() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+}
+
+func (ecdsaScheme) Sign(key crypto.Signer, hm []byte) ([]byte, error) {
+	return key.Sign(crand.Reader, hm, crypto.SHA256)
+}
+
+func (ecdsaScheme) Verify(key crypto.PublicKey, hm []byte, signature []byte) bool {
+	k, ok := key.(*ecdsa.PublicKey)
+	return ok && ecdsa.VerifyASN1(k, hm, signature)
+}
+
+// ed25519, signing the hashed message
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) Name() string { return "ed25519" }
+
+func (ed25519Scheme) Generate() (crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(crand.Reader)
+	return key, err
+}
+
+func (ed25519Scheme) Sign(key crypto.Signer, hm []byte) ([]byte, error) {
+	return key.Sign(crand.Reader, hm, crypto.Hash(0))
+}
+
+func (ed25519Scheme) Verify(key crypto.PublicKey, hm []byte, signature []byte) bool {
+	k, ok := key.(ed25519.PublicKey)
+	return ok && ed25519.Verify(k, hm, signature)
+}
+
+// find the scheme a public key belongs to
+func schemeOf(key crypto.PublicKey) (Scheme, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return schemes["rsa"], nil
+	case *ecdsa.PublicKey:
+		return schemes["ecdsa"], nil
+	case ed25519.PublicKey:
+		return schemes["ed25519"], nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// sign a hashed message with the given key, using the scheme of the key
+func signWith(key crypto.Signer, hm []byte) ([]byte, error) {
+	scheme, err := schemeOf(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return scheme.Sign(key, hm)
+}
+
+// encode a public key as a string, prefixed with the name of its scheme
+func encodeKey(key crypto.PublicKey) string {
+	scheme, err := schemeOf(key)
+	if err != nil {
+		return ""
+	}
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	return scheme.Name() + ":" + base64.StdEncoding.EncodeToString(der)
+}
+
+// decode a public key encoded with encodeKey. keys without a prefix are rsa keys
+func decodeKey(s string) (crypto.PublicKey, Scheme, error) {
+	name, encoded, found := strings.Cut(s, ":")
+	if !found {
+		name, encoded = "rsa", s
+	}
+	scheme, exists := schemes[name]
+	if !exists {
+		return nil, nil, errors.New("unknown signature scheme " + name)
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if actual, err := schemeOf(key); err != nil || actual.Name() != name {
+		return nil, nil, errors.New("not a " + name + " key")
+	}
+	return key, scheme, nil
+}
+
+type Transaction struct {
+	ID     string  // Any string
+	From   string  // A verification key coded as a string
+	To     string  // A verification key coded as a string
+	Amount int     // Amount to transfer
+	Fee    int     // Fee paid by the sender, on top of the amount
+	Policy *Policy `json:",omitempty"` // If set, To is created as a shared account with this policy
+}
+
+type SignedTransaction struct {
+	T          Transaction       // The transaction
+	Signature  []byte            // Potential signature coded as string
+	Signatures map[string][]byte // Signatures of the owners, if the sender is a shared account
+	Trace      *SpanContext      `json:"-"` // the span of the peer that sent it to us. not part of the transaction
+	span       *Span             // our own span, while the transaction is in our pipeline
+}
+
+// pbft mode. the replicas listed with -pbft agree on the order of all transactions with pbft, so the ledger
+// stays consistent as long as at most f of the 3f+1 replicas are faulty, even if they lie or withhold
+// messages. the primary of the current view assigns every request a sequence number (pre-prepare), the
+// replicas confirm they have seen the same assignment (prepare), and then that enough of them have (commit).
+// a transaction is executed once 2f+1 replicas have committed to it, in the order of the sequence numbers.
+// if a request is not executed in time, the replicas move to the next view with a new primary.
+// every message is signed with the key of its replica and flooded through the network, so replicas do not
+// need to be directly connected, and peers that are not replicas follow along and execute the same
+// transactions. there are no checkpoints, so the log is never truncated, and a peer that joins after
+// transactions have been ordered does not catch up. the keys of the replicas and of every sender must be pinned
+// by the genesis, since keys learned from the network arrive at a different time on every replica
+
+var pbft *Pbft // nil unless running with -pbft
+var pbftTimeout time.Duration
+
+type Pbft struct {
+	lock          sync.Mutex
+	replicas      []string
+	f             int // faulty replicas we can tolerate
+	view          int
+	changing      bool // we have left the view, and are waiting for the next one to start
+	changeStarted time.Time
+	seq           int // the last sequence number we assigned as primary
+	executed      int // the last sequence number we executed
+	slots         map[int]*pbftSlot
+	pending       map[string]SignedTransaction // digest to requests that have not been executed yet
+	pendingSince  map[string]time.Time
+	assigned      map[string]bool // digests that have a sequence number in the current view
+	viewChanges   map[int]map[string]ViewChange
+	newViewSent   map[int]bool
+	seen          map[string]bool // hashes of the messages we have processed and passed on
+	early         []PbftMessage   // pre-prepares of a view that has not started yet
+}
+
+// everything we know about a single sequence number
+type pbftSlot struct {
+	prePrepare *PbftMessage
+	prepares   map[string]PbftMessage // replica to its latest prepare
+	commits    map[string]PbftMessage
+	sentCommit bool
+}
+
+// a pre-prepare, prepare or commit
+type PbftMessage struct {
+	Kind      string
+	View      int
+	Seq       int
+	Digest    string             // identifies the request. empty for a null request, which does nothing
+	Request   *SignedTransaction `json:",omitempty"` // only sent with pre-prepares
+	Replica   string
+	Signature []byte
+}
+
+// a pre-prepare together with the prepares of 2f other replicas, proving that a quorum agreed on it
+type PreparedProof struct {
+	PrePrepare PbftMessage
+	Prepares   []PbftMessage
+}
+
+// a vote to move to a new view, with everything the replica has prepared
+type ViewChange struct {
+	View      int
+	Prepared  []PreparedProof
+	Replica   string
+	Signature []byte
+}
+
+// sent by the primary of a new view, with the 2f+1 view changes that started it, and the pre-prepares
+// that carry the prepared requests over to the new view
+type NewView struct {
+	View        int
+	ViewChanges []ViewChange
+	PrePrepares []PbftMessage
+	Replica     string
+	Signature   []byte
+}
+
+const (
+	prePrepare = "pre-prepare"
+	prepare    = "prepare"
+	commit     = "commit"
+)
+
+func MakePbft(replicas []string) *Pbft {
+	p := new(Pbft)
+	p.replicas = replicas
+	p.f = (len(replicas) - 1) / 3
+	p.slots = make(map[int]*pbftSlot)
+	p.pending = make(map[string]SignedTransaction)
+	p.pendingSince = make(map[string]time.Time)
+	p.assigned = make(map[string]bool)
+	p.viewChanges = make(map[int]map[string]ViewChange)
+	p.newViewSent = make(map[int]bool)
+	p.seen = make(map[string]bool)
+	return p
+}
+
+// a client request. every peer receiving it passes it on, so it reaches the primary, and every replica
+// can notice if the primary does not order it
+func (l *Listener) PbftRequest(request SignedTransaction, reply *bool) error {
+	defer rpcCall("PbftRequest", "tx", request.T.ID)()
+	record("PbftRequest", request)
+	pbft.request(request)
+	return nil
+}
+
+func (l *Listener) PbftMessage(request PbftMessage, reply *bool) error {
+	defer rpcCall("PbftMessage")()
+	record("PbftMessage", request)
+	pbft.lock.Lock()
+	defer pbft.lock.Unlock()
+	if pbft.firstSeen(request.hash(), request.Replica, request.Signature) {
+		broadcast("Listener.PbftMessage", request)
+		pbft.handleMessage(request)
+	}
+	return nil
+}
+
+func (l *Listener) PbftViewChange(request ViewChange, reply *bool) error {
+	defer rpcCall("PbftViewChange")()
+	record("PbftViewChange", request)
+	pbft.lock.Lock()
+	defer pbft.lock.Unlock()
+	if pbft.firstSeen(request.hash(), request.Replica, request.Signature) {
+		broadcast("Listener.PbftViewChange", request)
+		pbft.handleViewChange(request)
+	}
+	return nil
+}
+
+func (l *Listener) PbftNewView(request NewView, reply *bool) error {
+	defer rpcCall("PbftNewView")()
+	record("PbftNewView", request)
+	pbft.lock.Lock()
+	defer pbft.lock.Unlock()
+	if pbft.firstSeen(request.hash(), request.Replica, request.Signature) {
+		broadcast("Listener.PbftNewView", request)
+		pbft.handleNewView(request)
+	}
+	return nil
+}
+
+// order a transaction. if we are the primary it gets the next sequence number, otherwise we wait for the primary.
+// a request that is not signed by pinned keys would be rejected by every replica once ordered, so it is dropped
+// right away instead of costing a round of messages. a request from a shared account that has not been created
+// here yet is dropped too, and must be sent again
+func (p *Pbft) request(st SignedTransaction) {
+	ledger.lock.Lock()
+	done := pastTransactions[st.T.ID]
+	ledger.lock.Unlock()
+	if done {
+		return
+	}
+	if !signedByPinned(st) {
+		logPbft.Info("dropped request", "tx", st.T.ID, "reason", "signed by a key the genesis does not pin")
+		reject(st, "unpinned_key")
+		return
+	}
+	if !validateSignature(st) {
+		logPbft.Info("dropped request", "tx", st.T.ID, "reason", "invalid signature")
+		reject(st, "bad_signature")
+		return
+	}
+	d := digest(st)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, exists := p.pending[d]; exists {
+		return
+	}
+	p.pending[d] = st
+	p.pendingSince[d] = time.Now()
+	broadcast("Listener.PbftRequest", st)
+	p.assign(d)
+}
+
+// helper method, give a pending request a sequence number if we are the primary. the lock must be held
+func (p *Pbft) assign(d string) {
+	if p.primary(p.view) != myid || p.changing || p.assigned[d] {
+		return
+	}
+	st := p.pending[d]
+	p.seq++
+	p.assigned[d] = true
+	p.send(PbftMessage{Kind: prePrepare, View: p.view, Seq: p.seq, Digest: d, Request: &st})
+}
+
+// helper method, handles a valid pre-prepare, prepare or commit. the lock must be held
+func (p *Pbft) handleMessage(m PbftMessage) {
+	if m.View < p.view {
+		return // an old view
+	}
+	slot := p.slot(m.Seq)
+	switch m.Kind {
+	case prePrepare:
+		if m.View > p.view || p.changing {
+			p.early = append(p.early, m) // handled once the view has started
+			return
+		}
+		if m.Replica != p.primary(m.View) || (m.Request == nil) != (m.Digest == "") || (m.Request != nil && digest(*m.Request) != m.Digest) {
+			return
+		}
+		if slot.prePrepare != nil && slot.prePrepare.View == m.View {
+			if slot.prePrepare.Digest != m.Digest {
+				logPbft.Warn("the primary assigned two requests to one sequence number", "replica", m.Replica, "seq", m.Seq)
+			}
+			return // only the first assignment of a view counts
+		}
+		slot.prePrepare = &m
+		slot.sentCommit = false
+		p.assigned[m.Digest] = true
+		if p.isReplica(myid) && m.Replica != myid {
+			p.send(PbftMessage{Kind: prepare, View: m.View, Seq: m.Seq, Digest: m.Digest})
+		}
+	case prepare:
+		if m.Replica == p.primary(m.View) {
+			return // the pre-prepare is the prepare of the primary
+		}
+		slot.prepares[m.Replica] = m
+	case commit:
+		slot.commits[m.Replica] = m
+	}
+	if p.prepared(slot) && !slot.sentCommit && p.isReplica(myid) {
+		slot.sentCommit = true
+		p.send(PbftMessage{Kind: commit, View: slot.prePrepare.View, Seq: m.Seq, Digest: slot.prePrepare.Digest})
+	}
+	p.execute()
+}
+
+// helper method, whether 2f other replicas have prepared the same request as the pre-prepare
+func (p *Pbft) prepared(slot *pbftSlot) bool {
+	return slot.prePrepare != nil && len(p.matching(slot.prepares, slot.prePrepare)) >= 2*p.f
+}
+
+// helper method, whether 2f+1 replicas have committed to the request of the pre-prepare
+func (p *Pbft) committed(slot *pbftSlot) bool {
+	return p.prepared(slot) && len(p.matching(slot.commits, slot.prePrepare)) >= 2*p.f+1
+}
+
+// helper method, the messages that agree with the pre-prepare
+func (p *Pbft) matching(messages map[string]PbftMessage, pp *PbftMessage) []PbftMessage {
+	var ms []PbftMessage
+	for _, m := range messages {
+		if m.View == pp.View && m.Digest == pp.Digest {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// helper method, execute the committed requests, in order. the lock must be held
+func (p *Pbft) execute() {
+	for {
+		slot, exists := p.slots[p.executed+1]
+		if !exists || !p.committed(slot) {
+			return
+		}
+		p.executed++
+		if slot.prePrepare.Request != nil {
+			executeTransaction(*slot.prePrepare.Request)
+		}
+		delete(p.pending, slot.prePrepare.Digest)
+		delete(p.pendingSince, slot.prePrepare.Digest)
+	}
+}
+
+// helper method, applies an ordered transaction. every correct peer executes the same transactions in the
+// same order, so they all accept and reject the same ones. there is no mempool, a transaction the sender
+// cannot afford at its place in the order is rejected
+func executeTransaction(st SignedTransaction) {
+	if !signedByPinned(st) {
+		logLedger.Info("rejected", "tx", st.T.ID, "reason", "signed by a key the genesis does not pin")
+		reject(st, "unpinned_key")
+		return
+	}
+	if !checkTransaction(st) {
+		return
+	}
+	switch applySignedTransaction(st) {
+	case applied:
+		logLedger.Debug("applied", "tx", st.T.ID, "from", st.T.From, "to", st.T.To, "amount", st.T.Amount, "fee", st.T.Fee)
+		metrics.appliedTotal.Add(1)
+	case duplicate:
+		reject(st, "duplicate")
+	case rejected:
+		reject(st, "shared_account")
+	case unfunded:
+		logLedger.Info("rejected", "tx", st.T.ID, "reason", "insufficient funds")
+		reject(st, "insufficient_funds")
+	}
+}
+
+// helper method, whether every key signing the transaction is pinned by the genesis. replicas learn the other
+// keys from the network at different times, so a request signed with one of them could be valid on some
+// replicas and invalid on others. the genesis is the same everywhere
+func signedByPinned(st SignedTransaction) bool {
+	ledger.lock.Lock()
+	_, shared := ledger.Policies[st.T.From]
+	ledger.lock.Unlock()
+	if !shared {
+		return pinned(st.T.From)
+	}
+	for owner := range st.Signatures {
+		if !pinned(owner) {
+			return false
+		}
+	}
+	return true
+}
+
+// helper method, whether the genesis pins the key of the account
+func pinned(account string) bool {
+	if genesis == nil {
+		return false
+	}
+	for _, a := range genesis.Accounts {
+		if a.Account == account && a.Key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// start elections when requests are not executed in time. a view change that does not finish in time is
+// followed by one to the view after it
+func (p *Pbft) timer() {
+	if !p.isReplica(myid) {
+		return // peers that are not replicas only follow along
+	}
+	for {
+		time.Sleep(pbftTimeout / 10)
+		p.lock.Lock()
+		if p.changing {
+			if time.Since(p.changeStarted) > 2*pbftTimeout {
+				p.startViewChange(p.view + 1)
+			}
+		} else {
+			for _, since := range p.pendingSince {
+				if time.Since(since) > pbftTimeout {
+					p.startViewChange(p.view + 1)
+					break
+				}
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// helper method, leave the current view and vote for the given one. the lock must be held
+func (p *Pbft) startViewChange(view int) {
+	logPbft.Info("moving to a new view", "view", view, "primary", p.primary(view))
+	p.view = view
+	p.changing = true
+	p.changeStarted = time.Now()
+	vc := ViewChange{View: view}
+	for _, slot := range p.slots {
+		if p.prepared(slot) {
+			proof := PreparedProof{PrePrepare: *slot.prePrepare, Prepares: p.matching(slot.prepares, slot.prePrepare)}
+			proof.Prepares = proof.Prepares[:2*p.f] // 2f is enough
+			vc.Prepared = append(vc.Prepared, proof)
+		}
+	}
+	sort.Slice(vc.Prepared, func(i, j int) bool { return vc.Prepared[i].PrePrepare.Seq < vc.Prepared[j].PrePrepare.Seq })
+	p.send(vc)
+}
+
+// helper method, handles a valid view change. the lock must be held
+func (p *Pbft) handleViewChange(vc ViewChange) {
+	if vc.View <= p.view && !(vc.View == p.view && p.changing) {
+		return // an old view
+	}
+	if !p.validViewChange(vc) {
+		return
+	}
+	if p.viewChanges[vc.View] == nil {
+		p.viewChanges[vc.View] = make(map[string]ViewChange)
+	}
+	p.viewChanges[vc.View][vc.Replica] = vc
+
+	// if f+1 replicas want a later view, at least one of them is correct, so we join them
+	if p.isReplica(myid) && vc.View > p.view {
+		votes := make(map[string]int) // replica to the smallest view it wants
+		for view, vcs := range p.viewChanges {
+			if view > p.view {
+				for replica := range vcs {
+					if v, exists := votes[replica]; !exists || view < v {
+						votes[replica] = view
+					}
+				}
+			}
+		}
+		if len(votes) >= p.f+1 {
+			smallest := 0
+			for _, view := range votes {
+				if smallest == 0 || view < smallest {
+					smallest = view
+				}
+			}
+			p.startViewChange(smallest)
+		}
+	}
+
+	// the new primary starts the view once 2f+1 replicas have voted for it
+	if p.primary(vc.View) == myid && !p.newViewSent[vc.View] && len(p.viewChanges[vc.View]) >= 2*p.f+1 {
+		p.newViewSent[vc.View] = true
+		nv := NewView{View: vc.View}
+		for _, vc := range p.viewChanges[vc.View] {
+			nv.ViewChanges = append(nv.ViewChanges, vc)
+			if len(nv.ViewChanges) == 2*p.f+1 {
+				break
+			}
+		}
+		for _, m := range p.carriedOver(nv.View, nv.ViewChanges) {
+			m.Replica = myid
+			m.Signature, _ = signWith(signer, m.hash())
+			nv.PrePrepares = append(nv.PrePrepares, m)
+		}
+		p.send(nv)
+	}
+}
+
+// helper method, the pre-prepares of a new view. every request prepared in an earlier view keeps its
+// sequence number, since it might have been executed by someone, and the gaps are filled with null requests
+func (p *Pbft) carriedOver(view int, vcs []ViewChange) []PbftMessage {
+	best := make(map[int]PbftMessage) // sequence number to the pre-prepare prepared in the latest view
+	maxSeq := 0
+	for _, vc := range vcs {
+		for _, proof := range vc.Prepared {
+			pp := proof.PrePrepare
+			if old, exists := best[pp.Seq]; !exists || pp.View > old.View {
+				best[pp.Seq] = pp
+			}
+			if pp.Seq > maxSeq {
+				maxSeq = pp.Seq
+			}
+		}
+	}
+	var ms []PbftMessage
+	for seq := 1; seq <= maxSeq; seq++ {
+		m := PbftMessage{Kind: prePrepare, View: view, Seq: seq}
+		if pp, exists := best[seq]; exists {
+			m.Digest = pp.Digest
+			m.Request = pp.Request
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// helper method, handles a valid new view. the lock must be held
+func (p *Pbft) handleNewView(nv NewView) {
+	if nv.View < p.view || (nv.View == p.view && !p.changing) || nv.Replica != p.primary(nv.View) {
+		return
+	}
+	voters := make(map[string]bool)
+	for _, vc := range nv.ViewChanges {
+		if vc.View != nv.View || !vc.valid() || !p.isReplica(vc.Replica) || !p.validViewChange(vc) {
+			return
+		}
+		voters[vc.Replica] = true
+	}
+	if len(voters) < 2*p.f+1 {
+		return
+	}
+	expected := p.carriedOver(nv.View, nv.ViewChanges)
+	if len(expected) != len(nv.PrePrepares) {
+		return
+	}
+	for i, m := range nv.PrePrepares {
+		if m.Seq != expected[i].Seq || m.Digest != expected[i].Digest || m.View != nv.View || m.Replica != nv.Replica || !m.valid() {
+			return // the primary did not carry over what was prepared
+		}
+	}
+	logPbft.Info("view started", "view", nv.View, "primary", nv.Replica)
+	p.view = nv.View
+	p.changing = false
+	p.assigned = make(map[string]bool)
+	p.seq = len(nv.PrePrepares)
+	for _, m := range nv.PrePrepares {
+		p.handleMessage(m)
+	}
+	early := p.early
+	p.early = nil
+	for _, m := range early {
+		p.handleMessage(m)
+	}
+	for d := range p.pendingSince {
+		p.pendingSince[d] = time.Now() // give the new primary a chance
+	}
+	if p.primary(p.view) == myid {
+		digests := make([]string, 0, len(p.pending))
+		for d := range p.pending {
+			digests = append(digests, d)
+		}
+		sort.Strings(digests)
+		for _, d := range digests {
+			p.assign(d)
+		}
+	}
+}
+
+// helper method, checks the prepared proofs in a view change
+func (p *Pbft) validViewChange(vc ViewChange) bool {
+	for _, proof := range vc.Prepared {
+		pp := proof.PrePrepare
+		if pp.Kind != prePrepare || pp.View >= vc.View || pp.Replica != p.primary(pp.View) || !pp.valid() {
+			return false
+		}
+		if pp.Request != nil && digest(*pp.Request) != pp.Digest {
+			return false
+		}
+		preparers := make(map[string]bool)
+		for _, m := range proof.Prepares {
+			if m.Kind != prepare || m.View != pp.View || m.Seq != pp.Seq || m.Digest != pp.Digest || m.Replica == pp.Replica || !p.isReplica(m.Replica) || !m.valid() {
+				return false
+			}
+			preparers[m.Replica] = true
+		}
+		if len(preparers) < 2*p.f {
+			return false
+		}
+	}
+	return true
+}
+
+// helper method, sign a message of ours, pass it on, and handle it ourselves. the lock must be held
+func (p *Pbft) send(message interface{}) {
+	switch m := message.(type) {
+	case PbftMessage:
+		m.Replica = myid
+		m.Signature, _ = signWith(signer, m.hash())
+		p.seen[hex.EncodeToString(m.hash())] = true
+		broadcast("Listener.PbftMessage", m)
+		p.handleMessage(m)
+	case ViewChange:
+		m.Replica = myid
+		m.Signature, _ = signWith(signer, m.hash())
+		p.seen[hex.EncodeToString(m.hash())] = true
+		broadcast("Listener.PbftViewChange", m)
+		p.handleViewChange(m)
+	case NewView:
+		m.Replica = myid
+		m.Signature, _ = signWith(signer, m.hash())
+		p.seen[hex.EncodeToString(m.hash())] = true
+		broadcast("Listener.PbftNewView", m)
+		p.handleNewView(m)
+	}
+}
+
+// helper method, whether a message is new to us and signed by a replica. messages we cannot verify are
+// not passed on. the lock must be held
+func (p *Pbft) firstSeen(hash []byte, replica string, signature []byte) bool {
+	h := hex.EncodeToString(hash)
+	if p.seen[h] || !p.isReplica(replica) || !verify(replica, hash, signature) {
+		return false
+	}
+	p.seen[h] = true
+	return true
+}
+
+func (p *Pbft) slot(seq int) *pbftSlot {
+	slot, exists := p.slots[seq]
+	if !exists {
+		slot = &pbftSlot{prepares: make(map[string]PbftMessage), commits: make(map[string]PbftMessage)}
+		p.slots[seq] = slot
+	}
+	return slot
+}
+
+func (p *Pbft) primary(view int) string {
+	return p.replicas[view%len(p.replicas)]
+}
+
+func (p *Pbft) isReplica(id string) bool {
+	for _, r := range p.replicas {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// identifies a request, including all of its signatures
+func digest(st SignedTransaction) string {
+	h := signatureHash(st)
+	return hex.EncodeToString(h[:])
+}
+
+// the hashes that are signed. everything but the signature is signed
+func (m PbftMessage) hash() []byte {
+	m.Signature = nil
+	return hashJSON(m)
+}
+
+func (vc ViewChange) hash() []byte {
+	vc.Signature = nil
+	return hashJSON(vc)
+}
+
+func (nv NewView) hash() []byte {
+	nv.Signature = nil
+	return hashJSON(nv)
+}
+
+func (m PbftMessage) valid() bool {
+	return verify(m.Replica, m.hash(), m.Signature)
+}
+
+func (vc ViewChange) valid() bool {
+	return verify(vc.Replica, vc.hash(), vc.Signature)
+}
+
+func hashJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	h := crypto.SHA256.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// an inbound call, or anything else that changed our state, as recorded in a trace file.
+// a trace file has one entry per line
+type TraceEntry struct {
+	Method string
+	Args   json.RawMessage
+}
+
+// the first entry of a trace. the rest of the trace only makes sense from the same starting point
+type StartEntry struct {
+	ID       string
+	Key      string
+	Genesis  string
+	Seed     int64
+	Replicas []string `json:",omitempty"` // the pbft replicas, if the peer ran with -pbft
+}
+
+// start recording to the given file
+func startTrace(file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
 	}
-	return ips
+	trace = json.NewEncoder(f)
 }
 
-type Ledger struct {
-	Accounts map[string]int
-	lock     sync.Mutex
+// write an entry to the trace file, if we are recording
+func record(method string, args interface{}) {
+	if trace == nil {
+		return
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return
+	}
+	traceLock.Lock()
+	trace.Encode(TraceEntry{Method: method, Args: b})
+	traceLock.Unlock()
 }
 
-func MakeLedger() *Ledger {
-	ledger := new(Ledger)
-	ledger.Accounts = make(map[string]int)
-	return ledger
+// run the entries of a trace file through the same code that handled them when they were recorded, without
+// any network, and print the resulting ledger. the invariants of the ledger are checked after every entry.
+// this turns a bug seen in a real network into something that can be run again and again
+func replay(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	initState()
+	startPipeline(1) // a single verifier applies the transactions in the order they were recorded
+	applyGenesis()
+	decoder := json.NewDecoder(f)
+	for n := 1; decoder.More(); n++ {
+		var e TraceEntry
+		if err := decoder.Decode(&e); err != nil {
+			log.Fatal(err)
+		}
+		if err := replayEntry(e); err != nil {
+			log.Fatal("entry " + fmt.Sprint(n) + " (" + e.Method + "): " + err.Error())
+		}
+		inPipeline.Wait()
+		if err := checkInvariants(); err != nil {
+			log.Fatal("invariant broken after entry " + fmt.Sprint(n) + " (" + e.Method + "): " + err.Error())
+		}
+	}
+	fmt.Println("Replayed " + fmt.Sprint(len(ledger.history)) + " transactions")
+	fmt.Println(ledger.Accounts)
 }
 
-type Transaction struct {
-	ID     string // Any string
-	From   string // A verification key coded as a string
-	To     string // A verification key coded as a string
-	Amount int    // Amount to transfer
+// helper method, replays a single entry of a trace
+func replayEntry(e TraceEntry) error {
+	switch e.Method {
+	case "Start":
+		var start StartEntry
+		if err := json.Unmarshal(e.Args, &start); err != nil {
+			return err
+		}
+		if start.Genesis != genesisHash {
+			return errors.New("the trace was recorded with genesis " + start.Genesis + ", not " + genesisHash)
+		}
+		if len(start.Replicas) > 0 {
+			return errPbftReplay
+		}
+		mergeKeys(map[string]string{start.ID: start.Key})
+	case "Genesis": // written by the fuzzer, which makes up its own genesis
+		g := new(Genesis)
+		if err := json.Unmarshal(e.Args, g); err != nil {
+			return err
+		}
+		genesis = g
+		applyGenesis()
+	case "MergePeers":
+		var request map[string]Node
+		if err := json.Unmarshal(e.Args, &request); err != nil {
+			return err
+		}
+		mergePeers(request)
+	case "MergeKeys", "MergeKeysReply", "Pin":
+		var request map[string]string
+		if err := json.Unmarshal(e.Args, &request); err != nil {
+			return err
+		}
+		mergeKeys(request)
+	case "SyncHistory", "SyncHistoryReply", "ReconcileReply":
+		var request []SignedTransaction
+		if err := json.Unmarshal(e.Args, &request); err != nil {
+			return err
+		}
+		replayHistory(request)
+	case "MakeSignedTransaction", "Local":
+		var request SignedTransaction
+		if err := json.Unmarshal(e.Args, &request); err != nil {
+			return err
+		}
+		makeSignedTransaction(request)
+	case "ProposeTransaction", "LocalProposal":
+		var request SignedTransaction
+		if err := json.Unmarshal(e.Args, &request); err != nil {
+			return err
+		}
+		proposeTransaction(request)
+	case "PbftRequest", "PbftMessage", "PbftViewChange", "PbftNewView":
+		return errPbftReplay
+	}
+	return nil // the remaining calls do not change the ledger
 }
 
-type SignedTransaction struct {
-	T         Transaction // The transaction
-	Signature []byte      // Potential signature coded as string
+// with pbft, the ledger follows the votes of the replicas, and the votes of the recording peer itself are not
+// in its trace, since they were never inbound calls
+var errPbftReplay = errors.New("the trace was recorded with pbft, which cannot be replayed")
+
+// check what must always hold for the ledger: no account is overdrawn, no money is created or lost except
+// for burned fees, and every transaction in the history has been applied exactly once
+func checkInvariants() error {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	total := 0
+	for account, balance := range ledger.Accounts {
+		if balance < 0 {
+			return errors.New(account + " has a negative balance of " + fmt.Sprint(balance))
+		}
+		total += balance
+	}
+	burned := 0
+	seen := make(map[string]bool)
+	for _, st := range ledger.history {
+		if seen[st.T.ID] {
+			return errors.New("transaction " + st.T.ID + " was applied twice")
+		}
+		seen[st.T.ID] = true
+		if !pastTransactions[st.T.ID] {
+			return errors.New("transaction " + st.T.ID + " is in the history, but not marked as applied")
+		}
+		if rules.FeeAccount == "" {
+			burned += st.T.Fee
+		}
+	}
+	if len(seen) != len(pastTransactions) {
+		return errors.New(fmt.Sprint(len(pastTransactions)) + " transactions are marked as applied, but the history has " + fmt.Sprint(len(seen)))
+	}
+	if total != ledger.supply-burned {
+		return errors.New("the balances add up to " + fmt.Sprint(total) + ", but " + fmt.Sprint(ledger.supply-burned) + " should exist")
+	}
+	return nil
+}
+
+// deliver random sequences of transactions to the pipeline, and check the invariants after every delivery.
+// the transactions are a mix of valid ones, ones breaking the rules, ones with bad signatures, and ones
+// spending money that only arrives later, delivered out of order and several times. every run is derived
+// from the seed, and a failing run is written to a trace file that -replay runs again
+func fuzz(runs int) {
+	startPipeline(1)
+	setLogLevels("error") // the pipeline logs a lot
+	for i := 0; i < runs; i++ {
+		runSeed := seed + int64(i)
+		entries, err := fuzzRun(runSeed)
+		if err != nil {
+			file := "fuzz-" + fmt.Sprint(runSeed) + ".trace"
+			f, _ := os.Create(file)
+			encoder := json.NewEncoder(f)
+			for _, e := range entries {
+				encoder.Encode(e)
+			}
+			f.Close()
+			log.Fatal("run with seed " + fmt.Sprint(runSeed) + " failed: " + err.Error() + ". Replay it with -replay " + file)
+		}
+	}
+	fmt.Println("All " + fmt.Sprint(runs) + " runs passed")
+}
+
+// helper method, a single run of the fuzzer. returns the entries delivered, as a trace
+func fuzzRun(runSeed int64) ([]TraceEntry, error) {
+	r := rand.New(rand.NewSource(runSeed))
+	g := &Genesis{Rules: Rules{MinFee: r.Intn(2), MaxAmount: 50 + r.Intn(100)}}
+
+	// the accounts, with keys derived from the seed, and funded by the genesis
+	accounts := make([]string, 2+r.Intn(4))
+	signers := make(map[string]crypto.Signer)
+	for i := range accounts {
+		keySeed := make([]byte, ed25519.SeedSize)
+		r.Read(keySeed)
+		key := ed25519.NewKeyFromSeed(keySeed)
+		accounts[i] = nodeID(key.Public())
+		signers[accounts[i]] = key
+		g.Accounts = append(g.Accounts, GenesisAccount{Account: accounts[i], Key: encodeKey(key.Public()), Balance: 100})
+	}
+	if r.Intn(2) == 0 {
+		g.Rules.FeeAccount = accounts[0]
+	}
+
+	// the transactions
+	sts := make([]SignedTransaction, 5+r.Intn(30))
+	for i := range sts {
+		from := accounts[r.Intn(len(accounts))]
+		t := Transaction{
+			ID:     fmt.Sprint(r.Int63()),
+			From:   from,
+			To:     accounts[r.Intn(len(accounts))],
+			Amount: r.Intn(120) - 10,
+			Fee:    r.Intn(3),
+		}
+		signature, _ := signWith(signers[from], hashMessage(t))
+		if r.Intn(10) == 0 {
+			signature[r.Intn(len(signature))] ^= 1 // a bad signature
+		}
+		sts[i] = SignedTransaction{T: t, Signature: signature}
+	}
+
+	// deliver them in a random order, with duplicates
+	deliveries := make([]SignedTransaction, 2*len(sts))
+	for i := range deliveries {
+		deliveries[i] = sts[r.Intn(len(sts))]
+	}
+	return runFuzzCase(g, deliveries)
+}
+
+// start from the genesis, deliver the transactions to the pipeline in the given order, and check the invariants
+// after every delivery. in the end, applying the history from scratch must give the same balances. used by the
+// -fuzz mode and by the go fuzz target. returns the entries delivered, as a trace
+func runFuzzCase(g *Genesis, deliveries []SignedTransaction) ([]TraceEntry, error) {
+	initState()
+	verifiedLock.Lock()
+	verified = make(map[[32]byte]bool)
+	verifiedLock.Unlock()
+	var entries []TraceEntry
+	deliver := func(method string, args interface{}) error {
+		b, _ := json.Marshal(args)
+		e := TraceEntry{Method: method, Args: b}
+		entries = append(entries, e)
+		if err := replayEntry(e); err != nil {
+			return err
+		}
+		inPipeline.Wait()
+		if err := checkInvariants(); err != nil {
+			return errors.New(method + ": " + err.Error())
+		}
+		return nil
+	}
+	if err := deliver("Genesis", g); err != nil {
+		return entries, err
+	}
+	for _, st := range deliveries {
+		if err := deliver("MakeSignedTransaction", st); err != nil {
+			return entries, err
+		}
+	}
+
+	history := ledger.getHistory()
+	balances := make(map[string]int)
+	for k, v := range ledger.Accounts {
+		balances[k] = v
+	}
+	initState()
+	applyGenesis()
+	replayHistory(history)
+	inPipeline.Wait()
+	if len(ledger.history) != len(history) {
+		return entries, errors.New("replaying the history applied " + fmt.Sprint(len(ledger.history)) + " of " + fmt.Sprint(len(history)) + " transactions")
+	}
+	for k, v := range balances {
+		if ledger.Accounts[k] != v {
+			return entries, errors.New("replaying the history gives " + k + " " + fmt.Sprint(ledger.Accounts[k]) + " instead of " + fmt.Sprint(v))
+		}
+	}
+	return entries, nil
+}
+
+// poll every peer we can find for its state hash, and report forks and broken invariants. peers at the same
+// height must have the same root, otherwise they have applied different transactions. peers at a lower
+// height may just be behind. the peers are found by following the peer lists, starting from addr
+func checkNetwork(addr string, interval time.Duration) {
+	initState()                                // the keys learned in tls handshakes are kept there
+	signer = loadKey(keyFile, keyScheme)       // only used for tls
+	known := map[string][]string{addr: {addr}} // node ids to addresses. the first peer is named by its address until we know its id
+	var previous map[string]StateHash
+	for {
+		states := make(map[string]StateHash)
+		failed := make(map[string]bool)
+		for {
+			// the peers learned from one peer are polled in the same round, so every round covers the whole network
+			var unpolled []string
+			for _, p := range getipset(peersIn(known)) {
+				if _, polled := states[p]; !polled && !failed[p] {
+					unpolled = append(unpolled, p)
+				}
+			}
+			if len(unpolled) == 0 {
+				break
+			}
+			for _, p := range unpolled {
+				var state StateHash
+				if err := callAny(known[p], "Listener.GetStateHash", true, &state); err != nil {
+					fmt.Println(p + " did not return its state: " + err.Error())
+					failed[p] = true
+					continue
+				}
+				if state.ID != p {
+					delete(known, p)
+				}
+				states[state.ID] = state
+				for id, n := range state.Peers {
+					known[id] = appendNew(known[id], n.Addrs)
+				}
+			}
+		}
+		reportStates(states, previous)
+		previous = states
+		time.Sleep(interval)
+	}
+}
+
+// helper method, prints the result of a poll. peers at the same height may have different roots for a moment
+// while transactions spread, so a fork is only reported for peers whose root and height have not changed
+// since the previous poll
+func reportStates(states map[string]StateHash, previous map[string]StateHash) {
+	fmt.Println(time.Now().Format("15:04:05") + " polled " + fmt.Sprint(len(states)) + " peers")
+	top := 0
+	roots := make(map[int]map[string][]string) // height to root to peers
+	for _, p := range getipset(peersOf(states)) {
+		s := states[p]
+		if s.Total != s.Supply-s.Burned {
+			fmt.Println("  SUPPLY VIOLATION at " + p + ": the balances add up to " + fmt.Sprint(s.Total) + ", but " + fmt.Sprint(s.Supply-s.Burned) + " should exist")
+		}
+		if roots[s.Height] == nil {
+			roots[s.Height] = make(map[string][]string)
+		}
+		roots[s.Height][s.Root] = append(roots[s.Height][s.Root], p)
+		if s.Height > top {
+			top = s.Height
+		}
+	}
+	for height, byRoot := range roots {
+		if len(byRoot) < 2 {
+			continue
+		}
+		settled := make(map[string][]string) // root to the peers that were in the same state in the previous poll
+		for root, ps := range byRoot {
+			for _, p := range ps {
+				if last, exists := previous[p]; exists && last.Height == height && last.Root == root {
+					settled[root] = append(settled[root], p)
+				}
+			}
+		}
+		if len(settled) < 2 {
+			fmt.Println("  roots differ at height " + fmt.Sprint(height) + ", checking again on the next poll")
+			continue
+		}
+		fmt.Println("  FORK at height " + fmt.Sprint(height) + ":")
+		for root, ps := range settled {
+			fmt.Println("    " + root[:16] + " " + strings.Join(ps, " "))
+		}
+	}
+	for height, byRoot := range roots {
+		if height < top {
+			for _, ps := range byRoot {
+				fmt.Println("  " + strings.Join(ps, " ") + " behind at height " + fmt.Sprint(height) + " of " + fmt.Sprint(top))
+			}
+		}
+	}
+	if len(roots) == 1 && len(roots[top]) == 1 {
+		for root := range roots[top] {
+			fmt.Println("  all agree on " + root[:16] + " at height " + fmt.Sprint(top))
+		}
+	}
+}
+
+// a light client. it asks a single peer for the balance of an account and a proof of it, and only accepts the
+// balance if the proof leads to a root signed by a quorum of trusted peers. the peer could make up any number
+// of node ids of its own, so the trusted peers are never taken from it: they are the pbft replicas if given,
+// otherwise the accounts pinned to a key by the genesis. the keys of the replicas may come from the peer, since
+// they must match the node ids
+func lightClient(addr string, name string, quorum int, replicas []string) {
+	trusted := replicas
+	if len(trusted) == 0 && genesis != nil {
+		for _, a := range genesis.Accounts {
+			if a.Key != "" {
+				trusted = append(trusted, a.Account)
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		log.Fatal("the light client needs peers to trust, from -pbft or the keys of a -genesis")
+	}
+	initState()
+	applyGenesis()
+	signer = loadKey(keyFile, keyScheme) // only used for tls
+	conn, err := dial(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var state StateHash
+	if err := conn.Call("Listener.GetStateHash", true, &state); err != nil {
+		log.Fatal(err)
+	}
+	mergePeers(state.Peers) // so the account can be given by a prefix of its id, or an address
+	remoteKeys := make(map[string]string)
+	conn.Call("Listener.MergeKeys", map[string]string{}, &remoteKeys)
+	mergeKeys(remoteKeys)
+	var proof BalanceProof
+	err = conn.Call("Listener.GetBalanceWithProof", account(name), &proof)
+	conn.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !proof.verify(proof.Root.Root) {
+		log.Fatal("the proof of " + addr + " does not lead to its root")
+	}
+	if quorum == 0 {
+		quorum = len(trusted)/2 + 1 // a majority
+	}
+	signed := 0
+	for _, p := range trusted {
+		root := proof.Root
+		if p != state.ID {
+			root = SignedRoot{} // gob leaves the fields it does not receive untouched
+			if err := callAny(state.Peers[p].Addrs, "Listener.GetSignedRoot", true, &root); err != nil {
+				fmt.Println(p + " did not return its root: " + err.Error())
+				continue
+			}
+		}
+		if root.Signer != p || !verify(p, rootMessage(root), root.Signature) {
+			fmt.Println(p + " returned a root with an invalid signature")
+			continue
+		}
+		if !bytes.Equal(root.Root, proof.Root.Root) {
+			fmt.Println(p + " is at another root, at height " + fmt.Sprint(root.Height))
+			continue
+		}
+		signed++
+	}
+	if signed < quorum {
+		log.Fatal("only " + fmt.Sprint(signed) + " of the required " + fmt.Sprint(quorum) + " peers signed the root, try again once the network has settled")
+	}
+	fmt.Println("The balance of " + proof.Account + " is " + fmt.Sprint(proof.Balance) + ", signed by " + fmt.Sprint(signed) + " peers at height " + fmt.Sprint(proof.Root.Height))
+}
+
+// helper method, makes a single call to a peer, trying each of its addresses until one answers
+func callAny(as []string, method string, args interface{}, reply interface{}) error {
+	err := errors.New("no known address")
+	for _, a := range as {
+		var conn *rpc.Client
+		conn, err = dial(a)
+		if err != nil {
+			continue
+		}
+		err = conn.Call(method, args, reply)
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// helper method, the set of peers in a poll
+func peersOf(states map[string]StateHash) map[string]bool {
+	ps := make(map[string]bool)
+	for p := range states {
+		ps[p] = true
+	}
+	return ps
+}
+
+// the benchmark. it starts its own network of peers, or uses running ones, and funds its accounts with
+// transfers from the account of our key. a network it starts gets a genesis giving that account the money,
+// running peers need a genesis that funds our -key. it then submits
+// transfers between the accounts at the given rate, each to the next peer in turn, and polls every peer for
+// the transactions it has applied. a transaction is confirmed once every peer has applied it, and its
+// propagation latency is the time from submitting it until then, measured to within the poll interval
+func bench(launch int, targets []string, accounts int, rate float64, duration time.Duration) {
+	if accounts < 2 || rate <= 0 {
+		log.Fatal("the benchmark needs at least 2 accounts and a positive rate")
+	}
+	initState()
+	signer = loadKey(keyFile, keyScheme) // funds the accounts
+	funder := nodeID(signer.Public())
+	if launch > 0 {
+		if genesis != nil {
+			log.Fatal("the benchmark makes up its own genesis for the peers it starts, so it cannot run with -genesis")
+		}
+		file, err := writeBenchGenesis(accounts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(file)
+		var stop func()
+		targets, stop = launchPeers(launch, file)
+		defer stop()
+	} else if genesis == nil {
+		log.Fatal("without a genesis the running peers have no money, so give the benchmark their -genesis and the -key of an account it funds")
+	}
+	applyGenesis()
+	var clients []*rpc.Client
+	var ids []string // node ids of the peers
+	for _, addr := range targets {
+		conn, err := dial(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var state StateHash
+		if err := conn.Call("Listener.GetStateHash", true, &state); err != nil {
+			log.Fatal(err)
+		}
+		clients = append(clients, conn)
+		ids = append(ids, state.ID)
+	}
+
+	// the accounts, with keys derived from the seed. every peer needs their keys to check the transfers
+	signers := make([]crypto.Signer, accounts)
+	names := make([]string, accounts)
+	known := map[string]string{funder: encodeKey(signer.Public())}
+	for i := range signers {
+		keySeed := make([]byte, ed25519.SeedSize)
+		rng.Read(keySeed)
+		key := ed25519.NewKeyFromSeed(keySeed)
+		signers[i] = key
+		names[i] = nodeID(key.Public())
+		known[names[i]] = encodeKey(key.Public())
+	}
+	for _, c := range clients {
+		var reply map[string]string
+		if err := c.Call("Listener.MergeKeys", known, &reply); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var funding []string
+	for _, name := range names {
+		t := Transaction{ID: newID(), From: funder, To: name, Amount: benchFunding, Fee: rules.MinFee}
+		signature, _ := signWith(signer, hashMessage(t))
+		if err := clients[0].Call("Listener.MakeSignedTransaction", SignedTransaction{T: t, Signature: signature}, new(bool)); err != nil {
+			log.Fatal(err)
+		}
+		funding = append(funding, t.ID)
+	}
+	deadline := time.Now().Add(benchDrainTimeout)
+	for i := 0; i < len(clients); {
+		var reply []bool
+		if err := clients[i].Call("Listener.HasTransactions", funding, &reply); err != nil {
+			log.Fatal(err)
+		}
+		all := true
+		for _, done := range reply {
+			all = all && done
+		}
+		if all {
+			i++
+			continue
+		}
+		if time.Now().After(deadline) {
+			log.Fatal("the accounts were not funded. " + funder + " needs " + fmt.Sprint(accounts*(benchFunding+rules.MinFee)) + "$ to fund them")
+		}
+		time.Sleep(benchPollInterval)
+	}
+	fmt.Println("Funded " + fmt.Sprint(accounts) + " accounts on " + fmt.Sprint(len(clients)) + " peers")
+
+	// submit, and poll for the applied transactions at the same time
+	var lock sync.Mutex
+	var submitted []string                                // transaction ids, in the order they were submitted
+	sent := make(map[string]time.Time)                    // transaction id to when it was submitted
+	applied := make([]map[string]time.Time, len(clients)) // per peer, transaction id to when we saw it applied
+	for i := range applied {
+		applied[i] = make(map[string]time.Time)
+	}
+	var failed atomic.Int64
+	stopPolling := make(chan bool)
+	var polling sync.WaitGroup
+	for i := range clients {
+		polling.Add(1)
+		go func(i int) {
+			defer polling.Done()
+			for {
+				select {
+				case <-stopPolling:
+					return
+				case <-time.After(benchPollInterval):
+				}
+				lock.Lock()
+				var waiting []string
+				for _, id := range submitted {
+					if _, done := applied[i][id]; !done {
+						waiting = append(waiting, id)
+					}
+				}
+				lock.Unlock()
+				if len(waiting) == 0 {
+					continue
+				}
+				var reply []bool
+				if err := clients[i].Call("Listener.HasTransactions", waiting, &reply); err != nil {
+					continue
+				}
+				now := time.Now()
+				lock.Lock()
+				for j, done := range reply {
+					if done {
+						applied[i][waiting[j]] = now
+					}
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+	done := make(chan *rpc.Call, 1024)
+	go func() {
+		for call := range done {
+			if call.Error != nil {
+				failed.Add(1)
+			}
+		}
+	}()
+	fmt.Println("Submitting " + fmt.Sprint(rate) + " transactions per second for " + duration.String())
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	for n := 0; time.Since(start) < duration; n++ {
+		<-ticker.C
+		from := rng.Intn(accounts)
+		to := (from + 1 + rng.Intn(accounts-1)) % accounts // never the sender
+		t := Transaction{ID: newID(), From: names[from], To: names[to], Amount: 1, Fee: rules.MinFee}
+		signature, _ := signWith(signers[from], hashMessage(t))
+		lock.Lock()
+		submitted = append(submitted, t.ID)
+		sent[t.ID] = time.Now()
+		lock.Unlock()
+		clients[n%len(clients)].Go("Listener.MakeSignedTransaction", SignedTransaction{T: t, Signature: signature}, new(bool), done)
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+
+	// wait for the network to catch up
+	deadline = time.Now().Add(benchDrainTimeout)
+	for time.Now().Before(deadline) {
+		lock.Lock()
+		confirmed := 0
+		for _, id := range submitted {
+			all := true
+			for i := range applied {
+				_, seen := applied[i][id]
+				all = all && seen
+			}
+			if all {
+				confirmed++
+			}
+		}
+		lock.Unlock()
+		if confirmed == len(submitted) {
+			break
+		}
+		time.Sleep(benchPollInterval)
+	}
+	close(stopPolling)
+	polling.Wait()
+
+	// report
+	var propagation, first []time.Duration
+	var last time.Time
+	for _, id := range submitted {
+		var earliest, latest time.Time
+		complete := true
+		for i := range applied {
+			at, seen := applied[i][id]
+			if !seen {
+				complete = false
+				continue
+			}
+			if earliest.IsZero() || at.Before(earliest) {
+				earliest = at
+			}
+			if at.After(latest) {
+				latest = at
+			}
+		}
+		if !earliest.IsZero() {
+			first = append(first, earliest.Sub(sent[id]))
+		}
+		if complete {
+			propagation = append(propagation, latest.Sub(sent[id]))
+			if latest.After(last) {
+				last = latest
+			}
+		}
+	}
+	fmt.Println("Submitted " + fmt.Sprint(len(submitted)) + " transactions in " + elapsed.Round(time.Millisecond).String() + " (" + fmt.Sprintf("%.1f", float64(len(submitted))/elapsed.Seconds()) + " per second), " + fmt.Sprint(failed.Load()) + " calls failed")
+	if len(propagation) > 0 {
+		fmt.Println("Confirmed by all " + fmt.Sprint(len(clients)) + " peers: " + fmt.Sprint(len(propagation)) + " (" + fmt.Sprintf("%.1f", float64(len(propagation))/last.Sub(start).Seconds()) + " tps)")
+	} else {
+		fmt.Println("No transaction was confirmed by all peers")
+	}
+	fmt.Println("Latency until applied by the first peer:  " + percentiles(first))
+	fmt.Println("Latency until applied by every peer:      " + percentiles(propagation))
+	poll := func() map[string]StateHash {
+		states := make(map[string]StateHash)
+		for i, c := range clients {
+			var state StateHash
+			if err := c.Call("Listener.GetStateHash", true, &state); err == nil {
+				states[ids[i]] = state
+			}
+		}
+		return states
+	}
+	previous := poll()
+	time.Sleep(time.Second) // a fork is only reported if it is still there a second later
+	reportStates(poll(), previous)
+}
+
+const benchPollInterval = 20 * time.Millisecond
+const benchFunding = 100                   // money given to every account before the benchmark starts
+const benchDrainTimeout = 30 * time.Second // how long to wait for the network to apply everything after submitting
+
+// helper method, the percentiles of some latencies
+func percentiles(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "no data"
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	p := func(q float64) string {
+		return ds[int(q*float64(len(ds)-1))].Round(time.Millisecond / 10).String()
+	}
+	return "p50 " + p(0.5) + ", p90 " + p(0.9) + ", p99 " + p(0.99) + ", max " + p(1)
+}
+
+// helper method, makes up a genesis giving our key the money to fund the accounts of the benchmark, signs
+// it with our key, writes it to a temporary file, and uses it ourselves. returns the file
+func writeBenchGenesis(accounts int) (string, error) {
+	g := &Genesis{Accounts: []GenesisAccount{{Account: nodeID(signer.Public()), Key: encodeKey(signer.Public()), Balance: accounts * benchFunding}}}
+	g.Authority = encodeKey(signer.Public())
+	signature, err := signWith(signer, g.hash())
+	if err != nil {
+		return "", err
+	}
+	g.Signature = base64.StdEncoding.EncodeToString(signature)
+	f, err := os.CreateTemp("", "bench-*.genesis")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(g); err != nil {
+		return "", err
+	}
+	genesis = g
+	return f.Name(), nil
+}
+
+// start a network of n peers on this machine, each in its own process, with the given genesis file. returns
+// their addresses, and a function stopping them
+func launchPeers(n int, genesisFile string) ([]string, func()) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var addrs []string
+	var cmds []*exec.Cmd
+	var stdins []io.WriteCloser // kept open, the peers read their commands from it
+	stop := func() {
+		for _, cmd := range cmds {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	for i := 0; i < n; i++ {
+		args := []string{"-listen", "127.0.0.1:0", "-scheme", "ed25519", "-log", "warn", "-seed", fmt.Sprint(seed + int64(i) + 1), "-genesis", genesisFile}
+		if _, secure := transport.(*tlsTransport); secure {
+			args = append(args, "-tls")
+		}
+		cmd := exec.Command(exe, args...)
+		stdin, _ := cmd.StdinPipe()
+		stdout, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			stop()
+			log.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+		stdins = append(stdins, stdin)
+		bootstrap := ""
+		if i > 0 {
+			bootstrap = addrs[0]
+		}
+		io.WriteString(stdin, bootstrap+"\n")
+		lines := bufio.NewScanner(stdout)
+		for lines.Scan() {
+			if addr, found := strings.CutPrefix(lines.Text(), "Server waiting for connection at "); found {
+				addrs = append(addrs, addr)
+			}
+			if strings.HasPrefix(lines.Text(), "Ready to handle transactions") {
+				break // connected to the network
+			}
+		}
+		if len(addrs) != i+1 {
+			stop()
+			log.Fatal("peer " + fmt.Sprint(i) + " did not start")
+		}
+		go io.Copy(io.Discard, stdout)
+	}
+	fmt.Println("Started " + fmt.Sprint(n) + " peers at " + strings.Join(addrs, " "))
+	return addrs, func() {
+		stop()
+		for _, stdin := range stdins {
+			stdin.Close()
+		}
+	}
 }
 
 func main() {
+	useTLS := flag.Bool("tls", false, "use mutually authenticated tls between peers")
+	scenarioFile := flag.String("sim", "", "simulate the network conditions described in the given scenario file")
+	genesisFile := flag.String("genesis", "", "genesis file with the initial accounts and balances")
+	signFile := flag.String("sign-genesis", "", "sign the given unsigned genesis with -key, print it, and exit")
+	printKey := flag.Bool("print-key", false, "print the public key of -key, as used in a genesis, and exit")
+	printID := flag.Bool("print-id", false, "print the node id of -key, which is also its account, and exit")
+	schemeName := flag.String("scheme", "rsa", "signature scheme of new keys: rsa, ecdsa or ed25519")
+	flag.StringVar(&keyFile, "key", "", "file with our key, created if it does not exist")
+	flag.StringVar(&listenAddr, "listen", ":0", "address to listen on")
+	flag.StringVar(&advertise, "advertise", "", "comma separated host:port addresses other peers reach us at, such as a public address behind a port forward. defaults to the address we listen on")
+	flag.IntVar(&verifiers, "verifiers", runtime.NumCPU(), "number of goroutines verifying signatures")
+	flag.DurationVar(&mempoolTimeout, "mempool-timeout", time.Minute, "how long an unfunded transaction waits for funds")
+	flag.StringVar(&discoveryGroup, "discover", "", "multicast address to find peers on the lan at, such as 239.255.70.70:7070. off unless given, since every peer on the lan with the same genesis is joined")
+	seedAddr := flag.String("seed-node", "", "run as a seed node at the given address, tracking the live peers for new peers to start from")
+	seedList := flag.String("seeds", "", "comma separated addresses of seed nodes to register with and start from. a seed node exchanges its peers with these")
+	flag.DurationVar(&seedTTL, "seed-ttl", 30*time.Second, "how long a seed node remembers a peer that stops registering")
+	flag.DurationVar(&beaconInterval, "beacon-interval", 2*time.Second, "time between two discovery beacons")
+	flag.DurationVar(&antiEntropyInterval, "anti-entropy", 5*time.Second, "time between two rounds of anti-entropy with a random neighbour")
+	replicas := flag.String("pbft", "", "comma separated node ids of the replicas ordering the transactions with pbft. needs 3f+1 replicas to tolerate f faulty ones, and a -genesis pinning the keys of the replicas and senders. the light client trusts the roots of these peers")
+	flag.DurationVar(&pbftTimeout, "pbft-timeout", 2*time.Second, "how long a request may wait before the replicas move to a new view")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "seed of transaction ids and peer selection")
+	spansFile := flag.String("spans", "", "write a span for every hop of a transaction or new node to the given file, as opentelemetry json lines")
+	metricsAddr := flag.String("metrics", "", "serve prometheus metrics over http at the given address, such as :9100")
+	logList := flag.String("log", "info", "log levels, such as debug, or rpc=debug,ledger=warn for single subsystems. the subsystems are rpc, peers, ledger, pbft and net")
+	flag.BoolVar(&logJSON, "log-json", false, "log json lines instead of text")
+	recordFile := flag.String("record", "", "record every inbound call to the given trace file")
+	replayFile := flag.String("replay", "", "replay the given trace file without a network, print the ledger, and exit")
+	fuzzRuns := flag.Int("fuzz", 0, "run the given number of random transaction sequences against the ledger invariants, and exit")
+	checkAddr := flag.String("check", "", "poll the network of the peer at the given address for forks and broken invariants")
+	checkInterval := flag.Duration("check-interval", 2*time.Second, "time between two polls of -check")
+	benchPeers := flag.Int("bench", 0, "benchmark a network of the given number of peers started on this machine, and exit")
+	benchTargets := flag.String("bench-peers", "", "benchmark the running peers at the given comma separated addresses instead")
+	benchAccounts := flag.Int("bench-accounts", 100, "accounts the benchmark sends money between")
+	benchRate := flag.Float64("bench-rate", 100, "transactions the benchmark submits per second")
+	benchDuration := flag.Duration("bench-duration", 10*time.Second, "how long the benchmark submits transactions")
+	lightAddr := flag.String("light", "", "run as a light client against the peer at the given address, print the balance of -account, and exit")
+	lightAccount := flag.String("account", "", "account whose balance the light client verifies")
+	quorum := flag.Int("quorum", 0, "trusted peers that must have signed the root for the light client to accept a balance. 0 means a majority")
+	flag.Parse()
+	rng = rand.New(rand.NewSource(seed))
+	if err := setLogLevels(*logList); err != nil {
+		log.Fatal(err)
+	}
+	initLogging()
+	if *useTLS {
+		transport = &tlsTransport{}
+	}
+	if *scenarioFile != "" {
+		sc, err := loadScenario(*scenarioFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport = newSimTransport(transport, sc)
+	}
+	scheme, exists := schemes[*schemeName]
+	if !exists {
+		log.Fatal("unknown signature scheme " + *schemeName)
+	}
+	keyScheme = scheme
+	if *printKey {
+		fmt.Println(encodeKey(loadKey(keyFile, keyScheme).Public()))
+		return
+	}
+	if *printID {
+		fmt.Println(nodeID(loadKey(keyFile, keyScheme).Public()))
+		return
+	}
+	if *signFile != "" {
+		if err := signGenesis(*signFile, loadKey(keyFile, keyScheme)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *genesisFile != "" {
+		g, err := loadGenesis(*genesisFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		genesis = g
+	}
+	if *seedList != "" {
+		for _, s := range strings.Split(*seedList, ",") {
+			seeds = append(seeds, strings.TrimSpace(s))
+		}
+	}
+	if *seedAddr != "" {
+		seedNode(*seedAddr)
+		return
+	}
+	if *checkAddr != "" {
+		checkNetwork(*checkAddr, *checkInterval)
+		return
+	}
+	var rs []string
+	if *replicas != "" {
+		for _, r := range strings.Split(*replicas, ",") {
+			rs = append(rs, strings.TrimSpace(r))
+		}
+	}
+	if *lightAddr != "" {
+		lightClient(*lightAddr, *lightAccount, *quorum, rs)
+		return
+	}
+	if *benchPeers > 0 || *benchTargets != "" {
+		var targets []string
+		if *benchTargets != "" {
+			targets = strings.Split(*benchTargets, ",")
+		}
+		bench(*benchPeers, targets, *benchAccounts, *benchRate, *benchDuration)
+		return
+	}
+	if *fuzzRuns > 0 {
+		fuzz(*fuzzRuns)
+		return
+	}
+	if *replayFile != "" {
+		replay(*replayFile)
+		return
+	}
+	if rs != nil {
+		if genesis == nil {
+			log.Fatal("pbft needs a -genesis pinning the keys of the replicas and of every account sending money")
+		}
+		for _, r := range rs {
+			if !pinned(r) {
+				log.Fatal("the genesis does not pin the key of replica " + r)
+			}
+		}
+		pbft = MakePbft(rs)
+	}
+	if *recordFile != "" {
+		startTrace(*recordFile)
+	}
+	fmt.Println("Using seed " + fmt.Sprint(seed))
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+	if *spansFile != "" {
+		startSpans(*spansFile)
+	}
 	peer()
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+var testSetup sync.Once
+
+// the pipeline and the loggers are global, so they are started once for all tests
+func setupTest() {
+	testSetup.Do(func() {
+		setLogLevels("error") // the pipeline logs a lot
+		initLogging()
+		startPipeline(1)
+	})
+}
+
+// helper method, accounts with keys derived from their index, and a genesis giving each of them 100$
+func testAccounts(n int) ([]string, []crypto.Signer, *Genesis) {
+	accounts := make([]string, n)
+	signers := make([]crypto.Signer, n)
+	g := new(Genesis)
+	for i := range accounts {
+		keySeed := make([]byte, ed25519.SeedSize)
+		keySeed[0] = byte(i)
+		key := ed25519.NewKeyFromSeed(keySeed)
+		accounts[i] = nodeID(key.Public())
+		signers[i] = key
+		g.Accounts = append(g.Accounts, GenesisAccount{Account: accounts[i], Key: encodeKey(key.Public()), Balance: 100})
+	}
+	return accounts, signers, g
+}
+
+// deliver a sequence of transactions decoded from the input to the pipeline, with the same checks as -fuzz.
+// the first byte chooses the rules, and every following 5 bytes are a delivery: the sender, the receiver, the
+// amount, the fee, and whether the signature is broken or an earlier transaction is delivered again. run it
+// with go test -fuzz FuzzLedger peer.go peer_test.go
+func FuzzLedger(f *testing.F) {
+	f.Add([]byte{0, 0, 1, 60, 0, 0, 1, 2, 60, 1, 0})
+	f.Add([]byte{3, 1, 0, 200, 2, 0, 0, 1, 50, 0, 1, 2, 1, 20, 0, 6})
+	f.Add([]byte{6, 0, 1, 150, 0, 0, 1, 0, 150, 0, 0, 0, 1, 10, 0, 2})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		setupTest()
+		if len(data) == 0 {
+			return
+		}
+		accounts, signers, g := testAccounts(3)
+		g.Rules = Rules{MinFee: int(data[0] & 1), MaxAmount: 50 + int(data[0]>>2)}
+		if data[0]&2 != 0 {
+			g.Rules.FeeAccount = accounts[0]
+		}
+
+		var sent, deliveries []SignedTransaction
+		for i := 1; i+5 <= len(data) && len(sent) < 64; i += 5 {
+			op := data[i : i+5]
+			if op[4]&2 != 0 && len(sent) > 0 {
+				deliveries = append(deliveries, sent[int(op[4]>>2)%len(sent)]) // a duplicate
+				continue
+			}
+			from := int(op[0]) % len(accounts)
+			tr := Transaction{
+				ID:     fmt.Sprint(len(sent)),
+				From:   accounts[from],
+				To:     accounts[int(op[1])%len(accounts)],
+				Amount: int(op[2]) - 10,
+				Fee:    int(op[3]) % 3,
+			}
+			signature, _ := signWith(signers[from], hashMessage(tr))
+			if op[4]&1 != 0 {
+				signature[0] ^= 1 // a bad signature
+			}
+			st := SignedTransaction{T: tr, Signature: signature}
+			sent = append(sent, st)
+			deliveries = append(deliveries, st)
+		}
+		if _, err := runFuzzCase(g, deliveries); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// a proof of every balance, and of a missing account, leads to the root, and a changed one does not
+func TestBalanceProof(t *testing.T) {
+	l := MakeLedger()
+	for i := 0; i < 50; i++ {
+		account := fmt.Sprint("account", i)
+		l.Accounts[account] = i * 10
+		l.updateRoot(account)
+	}
+	for i := 0; i < 50; i++ {
+		proof := l.prove(fmt.Sprint("account", i))
+		if !proof.Exists || !proof.verify(l.root) {
+			t.Fatal("the proof of account" + fmt.Sprint(i) + " does not lead to the root")
+		}
+		proof.Balance++
+		if proof.verify(l.root) {
+			t.Fatal("a proof of a wrong balance of account" + fmt.Sprint(i) + " leads to the root")
+		}
+	}
+	missing := l.prove("nobody")
+	if missing.Exists || !missing.verify(l.root) {
+		t.Fatal("the proof of a missing account does not lead to the root")
+	}
+	missing.Balance = 10
+	if missing.verify(l.root) {
+		t.Fatal("a missing account has a proof of a balance")
+	}
+	absent := l.prove("account7")
+	absent.Exists = false
+	absent.Balance = 0
+	if absent.verify(l.root) {
+		t.Fatal("an existing account has a proof of being missing")
+	}
+	root := l.root
+	l.Accounts["account3"] = 1
+	l.updateRoot("account3")
+	if l.prove("account4").verify(root) {
+		t.Fatal("a proof leads to the root from before a balance changed")
+	}
+	if !l.prove("account3").verify(l.root) {
+		t.Fatal("the proof of a changed balance does not lead to the new root")
+	}
+}